@@ -0,0 +1,313 @@
+package raftpebble
+
+import (
+	"errors"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ErrReservedAppKey is an error indicating the empty app key is used,
+// which is reserved for the applied index, see AppBatch.SetAppliedIndex
+var ErrReservedAppKey = errors.New("reserved app key")
+
+var (
+	// appLowerBound is the inclusive lower bound of the application keys,
+	// after the reserved empty key
+	appLowerBound = []byte{prefixAppByte, 0x00}
+	// appUpperBound is the exclusive upper bound of the application namespace
+	appUpperBound = []byte{prefixAppByte + 1}
+)
+
+// AppStore is a handle of the application key namespace in the store db,
+// eg: the FSM state, so the FSM shares the cache, WAL and compactions with
+// the raft log, and can commit its state with the applied index in one batch.
+// the keys are confined under prefixApp, which never see raft logs/stable keys.
+// notice: the empty key is reserved for the applied index, return ErrReservedAppKey
+type AppStore struct {
+	s *PebbleKVStore
+}
+
+// App returns the application namespace handle
+func (s *PebbleKVStore) App() *AppStore {
+	return &AppStore{s: s}
+}
+
+// Get returns a copy of the value of key,
+// notice: if key/val not found return ErrKeyNotFound
+func (a *AppStore) Get(key []byte) (value []byte, err error) {
+	err = a.GetValue(key, func(val []byte) error {
+		value = make([]byte, len(val))
+		copy(value, val)
+		return nil
+	})
+
+	return
+}
+
+// GetValue calls op with the pebble owned value of key, zero-copy,
+// the value is only valid inside op.
+// notice: if key/val not found return ErrKeyNotFound
+func (a *AppStore) GetValue(key []byte, op func([]byte) error) error {
+	if len(key) == 0 {
+		return ErrReservedAppKey
+	}
+	kb := getKeyBuf()
+	appKey := encodeAppKey(kb.b[:0], key)
+	defer putKeyBuf(kb, appKey)
+
+	return a.s.GetValue(appKey, func(val []byte) error {
+		if val == nil {
+			return ErrKeyNotFound
+		}
+		return op(val)
+	})
+}
+
+// Set sets key to val in a single write
+func (a *AppStore) Set(key []byte, val []byte) error {
+	b := a.NewBatch()
+	defer b.Close()
+	if err := b.Set(key, val); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// Delete deletes key in a single write
+func (a *AppStore) Delete(key []byte) error {
+	b := a.NewBatch()
+	defer b.Close()
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// NewIter returns an iterator over the app keys in [lower,upper),
+// nil lower/upper is unbounded within the namespace.
+// notice: the iterator holds the store open until closed,
+// if the store is closed, it is empty and Error returns ErrClosed
+func (a *AppStore) NewIter(lower, upper []byte) *AppIter {
+	return newAppIter(a.s, a.s.db, lower, upper)
+}
+
+// NewSnapshot returns a point in time view of the namespace,
+// eg: for FSM Snapshot, which must be closed.
+// notice: the snapshot holds the store open until closed,
+// if the store is closed, Get returns ErrClosed
+func (a *AppStore) NewSnapshot() *AppSnapshot {
+	if err := a.s.acquire(); err != nil {
+		return &AppSnapshot{s: a.s}
+	}
+	return &AppSnapshot{s: a.s, snap: a.s.db.NewSnapshot()}
+}
+
+// NewBatch returns a write batch of the namespace, which must be closed
+func (a *AppStore) NewBatch() *AppBatch {
+	return &AppBatch{
+		s:  a.s,
+		wb: a.s.db.NewBatch(),
+	}
+}
+
+// AppBatch stages app writes, which are committed atomically
+type AppBatch struct {
+	s   *PebbleKVStore
+	wb  *pebble.Batch
+	key []byte
+}
+
+// Set stages setting key to val
+func (b *AppBatch) Set(key []byte, val []byte) error {
+	if len(key) == 0 {
+		return ErrReservedAppKey
+	}
+	// the batch copies the key
+	b.key = encodeAppKey(b.key[:0], key)
+	return b.wb.Set(b.key, val, nil)
+}
+
+// Delete stages deleting key
+func (b *AppBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrReservedAppKey
+	}
+	b.key = encodeAppKey(b.key[:0], key)
+	return b.wb.Delete(b.key, nil)
+}
+
+// DeleteRange stages deleting the keys in [start,end),
+// nil end deletes to the end of the namespace,
+// nil start deletes the applied index too, eg: before restoring a snapshot.
+func (b *AppBatch) DeleteRange(start, end []byte) error {
+	b.key = encodeAppKey(b.key[:0], start)
+	if end == nil {
+		return b.wb.DeleteRange(b.key, appUpperBound, nil)
+	}
+	return b.wb.DeleteRange(b.key, encodeAppKey(nil, end), nil)
+}
+
+// Empty returns true if nothing staged
+func (b *AppBatch) Empty() bool {
+	return b.wb.Empty()
+}
+
+// Commit commits the staged writes atomically
+func (b *AppBatch) Commit() (err error) {
+	if err = b.s.acquire(); err != nil {
+		return
+	}
+	defer b.s.release()
+	defer b.s.recoverFatal(&err)
+
+	if err = b.s.failure(); err != nil {
+		return
+	}
+	if err = b.s.checkDiskSpace(); err != nil {
+		return
+	}
+	return b.s.db.Apply(b.wb, b.s.defaultWriteOpts)
+}
+
+// Close releases the batch, uncommitted writes are dropped
+func (b *AppBatch) Close() error {
+	return b.wb.Close()
+}
+
+// AppSnapshot is a point in time view of the namespace
+type AppSnapshot struct {
+	s *PebbleKVStore
+	// nil if the store is closed
+	snap *pebble.Snapshot
+}
+
+// Get returns a copy of the value of key,
+// notice: if key/val not found return ErrKeyNotFound
+func (s *AppSnapshot) Get(key []byte) (value []byte, err error) {
+	if s.snap == nil {
+		return nil, ErrClosed
+	}
+	if len(key) == 0 {
+		return nil, ErrReservedAppKey
+	}
+	val, closer, err := s.snap.Get(encodeAppKey(nil, key))
+	if err == pebble.ErrNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return
+	}
+	value = make([]byte, len(val))
+	copy(value, val)
+
+	return value, closer.Close()
+}
+
+// NewIter returns an iterator over the app keys in [lower,upper) of the snapshot
+func (s *AppSnapshot) NewIter(lower, upper []byte) *AppIter {
+	if s.snap == nil {
+		return &AppIter{err: ErrClosed}
+	}
+	return newAppIter(s.s, s.snap, lower, upper)
+}
+
+// Close releases the snapshot
+func (s *AppSnapshot) Close() error {
+	if s.snap == nil {
+		return nil
+	}
+	defer s.s.release()
+	snap := s.snap
+	s.snap = nil
+	return snap.Close()
+}
+
+// AppIter iterates app keys, Key returns the key without prefixApp,
+// Key and Value are only valid until the next move.
+type AppIter struct {
+	s *PebbleKVStore
+	// nil if the store is closed
+	iter *pebble.Iterator
+	key  []byte
+	err  error
+}
+
+func newAppIter(s *PebbleKVStore, r pebble.Reader, lower, upper []byte) *AppIter {
+	if err := s.acquire(); err != nil {
+		return &AppIter{err: err}
+	}
+	opts := &pebble.IterOptions{
+		LowerBound: appLowerBound,
+		UpperBound: appUpperBound,
+	}
+	if len(lower) > 0 {
+		opts.LowerBound = encodeAppKey(nil, lower)
+	}
+	if upper != nil {
+		opts.UpperBound = encodeAppKey(nil, upper)
+	}
+	return &AppIter{s: s, iter: r.NewIter(opts)}
+}
+
+func (it *AppIter) First() bool {
+	return it.iter != nil && it.iter.First()
+}
+
+func (it *AppIter) Last() bool {
+	return it.iter != nil && it.iter.Last()
+}
+
+func (it *AppIter) Next() bool {
+	return it.iter != nil && it.iter.Next()
+}
+
+func (it *AppIter) Prev() bool {
+	return it.iter != nil && it.iter.Prev()
+}
+
+// SeekGE moves to the first key >= key
+func (it *AppIter) SeekGE(key []byte) bool {
+	if it.iter == nil {
+		return false
+	}
+	it.key = encodeAppKey(it.key[:0], key)
+	return it.iter.SeekGE(it.key)
+}
+
+// SeekLT moves to the last key < key
+func (it *AppIter) SeekLT(key []byte) bool {
+	if it.iter == nil {
+		return false
+	}
+	it.key = encodeAppKey(it.key[:0], key)
+	return it.iter.SeekLT(it.key)
+}
+
+func (it *AppIter) Valid() bool {
+	return it.iter != nil && it.iter.Valid()
+}
+
+func (it *AppIter) Key() []byte {
+	return it.iter.Key()[1:]
+}
+
+func (it *AppIter) Value() []byte {
+	return it.iter.Value()
+}
+
+func (it *AppIter) Error() error {
+	if it.iter == nil {
+		return it.err
+	}
+	return it.iter.Error()
+}
+
+func (it *AppIter) Close() error {
+	if it.iter == nil {
+		return nil
+	}
+	defer it.s.release()
+	iter := it.iter
+	it.iter = nil
+	return iter.Close()
+}
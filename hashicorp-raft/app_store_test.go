@@ -0,0 +1,157 @@
+package raftpebble
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func appKeys(it *AppIter) (keys []string) {
+	for it.First(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return
+}
+
+func TestAppStore(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	app := store.App()
+
+	_, err := app.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, app.Set([]byte("k1"), []byte("v1")))
+	val, err := app.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	// the raft stable namespace doesn't see app keys, and vice versa
+	_, err = store.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, store.Set([]byte("k2"), []byte("stable")))
+	_, err = app.Get([]byte("k2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, app.Delete([]byte("k1")))
+	_, err = app.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestAppStore_Isolation(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	app := store.App()
+
+	assert.Nil(t, store.StoreLogs([]*raft.Log{{Index: 1}, {Index: 2}}))
+	assert.Nil(t, store.SetUint64([]byte("CurrentTerm"), 1))
+	// the empty key is reserved for the applied index
+	assert.Equal(t, ErrReservedAppKey, app.Set([]byte{}, []byte("empty")))
+	_, err := app.Get(nil)
+	assert.Equal(t, ErrReservedAppKey, err)
+	assert.Nil(t, app.SetAppliedIndex(2))
+	// app keys sorting before the other namespaces
+	assert.Nil(t, app.Set([]byte{0x00}, []byte("zero")))
+	assert.Nil(t, app.Set([]byte{0xff}, []byte("ff")))
+
+	last, err := store.LastIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), last)
+
+	it := app.NewIter(nil, nil)
+	assert.Equal(t, []string{"\x00", "\xff"}, appKeys(it))
+	assert.Nil(t, it.Close())
+
+	// deleting the whole namespace keeps the raft state
+	b := app.NewBatch()
+	assert.Nil(t, b.DeleteRange(nil, nil))
+	assert.Nil(t, b.Commit())
+	assert.Nil(t, b.Close())
+
+	it = app.NewIter(nil, nil)
+	assert.Empty(t, appKeys(it))
+	assert.Nil(t, it.Close())
+	applied, err := app.AppliedIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), applied)
+	last, err = store.LastIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), last)
+	term, err := store.GetUint64([]byte("CurrentTerm"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), term)
+}
+
+func TestAppStore_BatchIterSnapshot(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	app := store.App()
+
+	// FSM state and applied index in one commit
+	b := app.NewBatch()
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, b.Set([]byte(fmt.Sprintf("state/%d", i)), []byte("v")))
+	}
+	assert.Nil(t, b.Set([]byte("applied"), uint64ToBytes(5)))
+	assert.False(t, b.Empty())
+
+	// nothing visible before commit
+	_, err := app.Get([]byte("applied"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, b.Commit())
+	assert.Nil(t, b.Close())
+
+	snap := app.NewSnapshot()
+
+	b = app.NewBatch()
+	assert.Nil(t, b.DeleteRange([]byte("state/1"), []byte("state/3")))
+	assert.Nil(t, b.Delete([]byte("state/4")))
+	assert.Nil(t, b.Set([]byte("applied"), uint64ToBytes(6)))
+	assert.Nil(t, b.Commit())
+	assert.Nil(t, b.Close())
+
+	it := app.NewIter([]byte("state/"), []byte("state0"))
+	assert.Equal(t, []string{"state/0", "state/3"}, appKeys(it))
+	assert.True(t, it.SeekGE([]byte("state/2")))
+	assert.Equal(t, []byte("state/3"), it.Key())
+	assert.True(t, it.SeekLT([]byte("state/2")))
+	assert.Equal(t, []byte("state/0"), it.Key())
+	assert.True(t, it.Last())
+	assert.Equal(t, []byte("state/3"), it.Key())
+	assert.False(t, it.Next())
+	assert.Nil(t, it.Error())
+	assert.Nil(t, it.Close())
+
+	// the snapshot keeps the point in time view
+	it = snap.NewIter([]byte("state/"), []byte("state0"))
+	assert.Len(t, appKeys(it), 5)
+	assert.Nil(t, it.Close())
+	applied, err := snap.Get([]byte("applied"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), bytesToUint64(applied))
+	_, err = snap.Get([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, snap.Close())
+
+	// kept across reopen
+	store = reopenTestPebbleKVStore(t, store)
+	applied, err = store.App().Get([]byte("applied"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), bytesToUint64(applied))
+}
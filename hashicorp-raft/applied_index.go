@@ -0,0 +1,167 @@
+package raftpebble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+)
+
+// ErrLogsCompacted is an error indicating the logs after the applied index
+// are deleted, the FSM must restore a snapshot before replaying.
+var ErrLogsCompacted = errors.New("logs after applied index are compacted")
+
+// appliedIndexKey is the reserved empty app key, so the applied index is
+// wiped with the app state, eg: AppBatch.DeleteRange(nil, nil) or Reset,
+// and read in the same AppSnapshot as the state.
+var appliedIndexKey = encodeAppKey(nil, nil)
+
+// legacyAppliedIndexKey is the meta key of the applied index before format 3
+var legacyAppliedIndexKey = encodeMetaKey(nil, []byte("applied_index"))
+
+// SetAppliedIndex stages the FSM applied index, which is committed
+// atomically with the FSM writes of the batch.
+func (b *AppBatch) SetAppliedIndex(index uint64) error {
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], index)
+	return b.wb.Set(appliedIndexKey, v[:], nil)
+}
+
+// SetAppliedIndex sets the FSM applied index in a single write,
+// use AppBatch.SetAppliedIndex to commit it with the FSM writes.
+func (a *AppStore) SetAppliedIndex(index uint64) error {
+	b := a.NewBatch()
+	defer b.Close()
+	if err := b.SetAppliedIndex(index); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// AppliedIndex returns the FSM applied index, 0 if never set,
+// FSM Apply can skip the logs <= AppliedIndex for exactly-once.
+func (a *AppStore) AppliedIndex() (index uint64, err error) {
+	err = a.s.GetValue(appliedIndexKey, func(val []byte) error {
+		index, err = decodeAppliedIndex(val)
+		return err
+	})
+
+	return
+}
+
+// AppliedIndex returns the FSM applied index of the snapshot, 0 if never set,
+// eg: the last index of the FSM snapshot.
+func (s *AppSnapshot) AppliedIndex() (uint64, error) {
+	if s.snap == nil {
+		return 0, ErrClosed
+	}
+	val, closer, err := s.snap.Get(appliedIndexKey)
+	if err == pebble.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+	return decodeAppliedIndex(val)
+}
+
+// decodeAppliedIndex returns 0 if val is nil, not set
+func decodeAppliedIndex(val []byte) (uint64, error) {
+	if val == nil {
+		return 0, nil
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("invalid applied index value, len %d", len(val))
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// migrateAppliedIndex moves the applied index from the meta key to the app key,
+// the empty app key written before format 3 can't be moved over.
+func migrateAppliedIndex(s *PebbleKVStore, progress func(uint64)) error {
+	var val []byte
+	err := s.GetValue(legacyAppliedIndexKey, func(v []byte) error {
+		val = append(val, v...)
+		return nil
+	})
+	if err != nil || val == nil {
+		return err
+	}
+	err = s.GetValue(appliedIndexKey, func(v []byte) error {
+		if v != nil && !bytes.Equal(v, val) {
+			return fmt.Errorf("%w: the empty app key is reserved for the applied index",
+				ErrReservedAppKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	wb := s.db.NewBatch()
+	defer wb.Close()
+	if err = wb.Set(appliedIndexKey, val, nil); err != nil {
+		return err
+	}
+	if err = wb.Delete(legacyAppliedIndexKey, nil); err != nil {
+		return err
+	}
+	if err = s.db.Apply(wb, pebble.Sync); err != nil {
+		return err
+	}
+	progress(1)
+	return nil
+}
+
+// Replay calls fn with the logs in (AppliedIndex, LastIndex] in order,
+// eg: on open, to recover the FSM from the applied state,
+// all log types are replayed, fn should skip the non command logs.
+// notice: if the logs after applied index are deleted return ErrLogsCompacted
+func (a *AppStore) Replay(fn func(log *raft.Log) error) (err error) {
+	s := a.s
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
+	applied, err := a.AppliedIndex()
+	if err != nil {
+		return
+	}
+	if s.isEmptyLog() {
+		return
+	}
+	first, err := s.FirstIndex()
+	if err != nil {
+		return
+	}
+	if first > applied+1 {
+		return fmt.Errorf("%w: applied %d, first %d", ErrLogsCompacted, applied, first)
+	}
+
+	fk := logKey(applied + 1)
+	iter := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: fk[:],
+		UpperBound: prefixConf,
+	})
+	defer func() {
+		err = FirstError(err, iter.Close())
+	}()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		log := new(raft.Log)
+		if err = decodeMsgPack(iter.Value(), log); err != nil {
+			return
+		}
+		if err = fn(log); err != nil {
+			return
+		}
+	}
+
+	return
+}
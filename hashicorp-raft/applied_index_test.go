@@ -0,0 +1,169 @@
+package raftpebble
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+// kvFSM applies "key=val" logs to the app namespace with the applied index
+type kvFSM struct {
+	app     *AppStore
+	applied []uint64
+}
+
+func (f *kvFSM) apply(log *raft.Log) error {
+	b := f.app.NewBatch()
+	defer b.Close()
+	if err := b.Set(log.Data, []byte("v")); err != nil {
+		return err
+	}
+	if err := b.SetAppliedIndex(log.Index); err != nil {
+		return err
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	f.applied = append(f.applied, log.Index)
+	return nil
+}
+
+func replayIndexes(t *testing.T, app *AppStore) []uint64 {
+	f := &kvFSM{app: app}
+	assert.Nil(t, app.Replay(f.apply))
+	return f.applied
+}
+
+func TestAppStore_AppliedIndex(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	app := store.App()
+
+	applied, err := app.AppliedIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), applied)
+	// nothing to replay on an empty log
+	assert.Empty(t, replayIndexes(t, app))
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Data: []byte{byte('a' + i)}})
+	}
+	assert.Nil(t, store.StoreLogs(logs))
+
+	// applies 1..4, then crashes
+	f := &kvFSM{app: app}
+	for _, log := range logs[:4] {
+		assert.Nil(t, f.apply(log))
+	}
+	// the FSM write and applied index are in the same commit
+	b := app.NewBatch()
+	assert.Nil(t, b.Set([]byte("lost"), []byte("v")))
+	assert.Nil(t, b.SetAppliedIndex(5))
+	assert.Nil(t, b.Close())
+
+	store = reopenTestPebbleKVStore(t, store)
+	app = store.App()
+	applied, err = app.AppliedIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), applied)
+	_, err = app.Get([]byte("lost"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// replays the rest exactly once
+	snap := app.NewSnapshot()
+	assert.Equal(t, []uint64{5, 6, 7, 8, 9, 10}, replayIndexes(t, app))
+	assert.Empty(t, replayIndexes(t, app))
+	applied, err = app.AppliedIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), applied)
+
+	// the snapshot reads the applied index with the state
+	applied, err = snap.AppliedIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), applied)
+	assert.Nil(t, snap.Close())
+	_, err = snap.AppliedIndex()
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestAppStore_AppliedIndex_Migration(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// written by format 2 under prefixMeta
+	assert.Nil(t, store.db.Set(legacyAppliedIndexKey, uint64ToBytes(7), pebble.Sync))
+	assert.Nil(t, store.writeFormatVersion(2))
+
+	store = reopenTestPebbleKVStore(t, store)
+	assert.Equal(t, formatVersion, store.FormatVersion())
+	applied, err := store.App().AppliedIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), applied)
+	_, closer, err := store.db.Get(legacyAppliedIndexKey)
+	if closer != nil {
+		closer.Close()
+	}
+	assert.Equal(t, pebble.ErrNotFound, err)
+
+	// an empty app key of format 2 is not overwritten
+	assert.Nil(t, store.db.Set(legacyAppliedIndexKey, uint64ToBytes(8), pebble.Sync))
+	assert.Nil(t, store.writeFormatVersion(2))
+	assert.Nil(t, store.Close())
+	_, err = New(
+		WithFS(store.options.fs),
+		WithWalDirPath(store.options.walDir),
+		WithDbDirPath(store.options.dir),
+	)
+	assert.True(t, errors.Is(err, ErrReservedAppKey), "err %v", err)
+}
+
+func TestAppStore_Replay_Compacted(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	app := store.App()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Data: []byte{byte('a' + i)}})
+	}
+	assert.Nil(t, store.StoreLogs(logs))
+	assert.Nil(t, app.SetAppliedIndex(3))
+
+	// truncated up to the applied index, replays the rest
+	assert.Nil(t, store.DeleteRange(1, 3))
+	assert.Equal(t, []uint64{4, 5, 6, 7, 8, 9, 10}, replayIndexes(t, app))
+
+	// truncated after the applied index, needs a snapshot
+	assert.Nil(t, app.SetAppliedIndex(3))
+	assert.Nil(t, store.DeleteRange(4, 5))
+	err := app.Replay(func(*raft.Log) error { return nil })
+	assert.True(t, errors.Is(err, ErrLogsCompacted), "err %v", err)
+
+	// fn error stops the replay
+	assert.Nil(t, app.SetAppliedIndex(5))
+	stop := errors.New("stop")
+	var n int
+	err = app.Replay(func(*raft.Log) error {
+		n++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, n)
+}
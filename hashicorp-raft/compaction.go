@@ -0,0 +1,221 @@
+package raftpebble
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
+)
+
+// CompactionStats are the counters of the truncated logs compactions
+type CompactionStats struct {
+	Compactions    uint64
+	ReclaimedBytes uint64
+}
+
+// compactSpanEntries bounds the logs compacted at once,
+// so Close waits at most one span of a long compaction.
+const compactSpanEntries uint64 = 16 * 1024
+
+// compactor compacts the truncated log spans in background,
+// so the disk space is reclaimed and FirstIndex doesn't skip the tombstones,
+// at most one compaction every minInterval.
+type compactor struct {
+	minEntries  uint64
+	minInterval time.Duration
+	signal      chan struct{}
+	// logs compacted at once, compactSpanEntries
+	span uint64
+
+	mu sync.Mutex
+	// deleted entries and the union span since the last compaction
+	pending uint64
+	lo, hi  uint64
+
+	compactions    uint64
+	reclaimedBytes uint64
+}
+
+func newCompactor(minEntries uint64, minInterval time.Duration) *compactor {
+	return &compactor{
+		minEntries:  minEntries,
+		minInterval: minInterval,
+		signal:      make(chan struct{}, 1),
+		span:        compactSpanEntries,
+	}
+}
+
+// add records the deleted logs [min,max], signals the worker past minEntries,
+// max is clamped to the last index by the caller, as no logs after it to reclaim.
+func (c *compactor) add(min, max uint64) {
+	if min > max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending == 0 || min < c.lo {
+		c.lo = min
+	}
+	if c.pending == 0 || max > c.hi {
+		c.hi = max
+	}
+	entries := max - min + 1
+	if entries == 0 || c.pending+entries < c.pending {
+		// saturate on overflow
+		c.pending = ^uint64(0)
+	} else {
+		c.pending += entries
+	}
+	if c.pending < c.minEntries {
+		return
+	}
+
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// take returns and resets the pending span
+func (c *compactor) take() (lo, hi uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending < c.minEntries {
+		return 0, 0, false
+	}
+	lo, hi = c.lo, c.hi
+	c.pending = 0
+	return lo, hi, true
+}
+
+// CompactionStats returns the truncated logs compaction counters,
+// notice: zero if not enabled with WithDeleteRangeCompaction
+func (s *PebbleKVStore) CompactionStats() CompactionStats {
+	if s.compactor == nil {
+		return CompactionStats{}
+	}
+	return CompactionStats{
+		Compactions:    atomic.LoadUint64(&s.compactor.compactions),
+		ReclaimedBytes: atomic.LoadUint64(&s.compactor.reclaimedBytes),
+	}
+}
+
+// runCompactor compacts the pending spans until stop
+func (s *PebbleKVStore) runCompactor() {
+	c := s.compactor
+	stop := s.event.stopper.ShouldStop()
+	var last time.Time
+	for {
+		select {
+		case <-c.signal:
+		case <-stop:
+			return
+		}
+		if wait := c.minInterval - time.Since(last); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+
+		// the deletes while waiting are merged into the span
+		lo, hi, ok := c.take()
+		if !ok {
+			continue
+		}
+		if err := s.compactLogs(lo, hi); err != nil && !errors.Is(err, ErrClosed) {
+			s.logEvent(hclog.Error, "compact logs failed", "min", lo, "max", hi, "error", err)
+		}
+		last = time.Now()
+	}
+}
+
+// compactLogs compacts the logs span [lo,hi] to the bottom level,
+// which drops the range tombstones and the deleted data.
+// the span is compacted in bounded spans, each holds a ref like a call,
+// so it stops with ErrClosed once closing or with the store failure.
+func (s *PebbleKVStore) compactLogs(lo, hi uint64) error {
+	before, err := s.estimateLogsUsage(lo, hi)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	for from := lo; ; {
+		to := hi
+		if hi-from >= s.compactor.span {
+			to = from + s.compactor.span - 1
+		}
+		if err = s.compactSpan(from, to); err != nil {
+			return err
+		}
+		if to == hi {
+			break
+		}
+		from = to + 1
+	}
+	after, err := s.estimateLogsUsage(lo, hi)
+	if err != nil {
+		return err
+	}
+
+	var reclaimed uint64
+	if before > after {
+		reclaimed = before - after
+	}
+	atomic.AddUint64(&s.compactor.compactions, 1)
+	atomic.AddUint64(&s.compactor.reclaimedBytes, reclaimed)
+	metrics.MeasureSince([]string{"raft", "pebble", "compaction", "duration"}, start)
+	metrics.IncrCounter([]string{"raft", "pebble", "compaction", "count"}, 1)
+	metrics.IncrCounter([]string{"raft", "pebble", "compaction", "reclaimedBytes"}, float32(reclaimed))
+
+	return nil
+}
+
+// compactSpan compacts the logs [from,to] to the bottom level
+func (s *PebbleKVStore) compactSpan(from, to uint64) (err error) {
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
+	if err = s.failure(); err != nil {
+		return
+	}
+	fk, lk := logSpanKeys(from, to)
+	return s.db.Compact(fk, lk, true)
+}
+
+// estimateLogsUsage returns the estimated disk usage of the logs [from,to]
+func (s *PebbleKVStore) estimateLogsUsage(from, to uint64) (n uint64, err error) {
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
+	if err = s.failure(); err != nil {
+		return
+	}
+	fk, lk := logSpanKeys(from, to)
+	return s.db.EstimateDiskUsage(fk, lk)
+}
+
+// logSpanKeys returns the key range [fk,lk) of the logs [from,to]
+func logSpanKeys(from, to uint64) (fk, lk []byte) {
+	k := logKey(from)
+	fk, lk = k[:], prefixConf
+	if to != ^uint64(0) {
+		k := logKey(to + 1)
+		lk = k[:]
+	}
+	return
+}
@@ -0,0 +1,146 @@
+package raftpebble
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func storeBigLogs(t *testing.T, store *PebbleKVStore, first, last uint64) {
+	var logs []*raft.Log
+	for i := first; i <= last; i++ {
+		data := make([]byte, 4096)
+		for j := range data {
+			// incompressible
+			data[j] = byte(i*31 + uint64(j)*17)
+		}
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Data: data})
+		if len(logs) == 256 {
+			assert.Nil(t, store.StoreLogs(logs))
+			logs = nil
+		}
+	}
+	if len(logs) > 0 {
+		assert.Nil(t, store.StoreLogs(logs))
+	}
+}
+
+func logsDiskUsage(t *testing.T, store *PebbleKVStore) uint64 {
+	fk := logKey(0)
+	n, err := store.db.EstimateDiskUsage(fk[:], prefixConf)
+	assert.Nil(t, err)
+	return n
+}
+
+func waitCompactions(t *testing.T, store *PebbleKVStore, n uint64) CompactionStats {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		st := store.CompactionStats()
+		if st.Compactions >= n {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("compactions %d, expected %d", st.Compactions, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPebbleKVStore_DeleteRangeCompaction(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithDeleteRangeCompaction(1000, 0))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	storeBigLogs(t, store, 1, 4000)
+	assert.Nil(t, store.db.Flush())
+	before := logsDiskUsage(t, store)
+	assert.True(t, before > 4000*4096, "disk usage %d", before)
+
+	// small truncations are not compacted
+	assert.Nil(t, store.DeleteRange(1, 100))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, CompactionStats{}, store.CompactionStats())
+
+	// past minEntries, the merged span is compacted
+	assert.Nil(t, store.DeleteRange(101, 3500))
+	st := waitCompactions(t, store, 1)
+	assert.Equal(t, uint64(1), st.Compactions)
+	assert.True(t, st.ReclaimedBytes > 3000*4096, "reclaimed %d", st.ReclaimedBytes)
+
+	after := logsDiskUsage(t, store)
+	assert.True(t, after < before/4, "disk usage %d, before %d", after, before)
+
+	first, err := store.FirstIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3501), first)
+}
+
+func TestPebbleKVStore_DeleteRangeCompaction_RateLimit(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithDeleteRangeCompaction(1, 300*time.Millisecond))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	storeBigLogs(t, store, 1, 1000)
+	assert.Nil(t, store.db.Flush())
+
+	assert.Nil(t, store.DeleteRange(1, 100))
+	waitCompactions(t, store, 1)
+
+	// the deletes in the interval are merged into one compaction
+	start := time.Now()
+	for i := uint64(101); i < 600; i += 100 {
+		assert.Nil(t, store.DeleteRange(i, i+99))
+	}
+	waitCompactions(t, store, 2)
+	assert.True(t, time.Since(start) > 200*time.Millisecond)
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, uint64(2), store.CompactionStats().Compactions)
+
+	// a txn truncation is compacted too
+	txn := store.NewTxn()
+	assert.Nil(t, txn.DeleteRange(601, 700))
+	assert.Nil(t, txn.Commit())
+	waitCompactions(t, store, 3)
+}
+
+func TestPebbleKVStore_DeleteRangeCompaction_Spans(t *testing.T) {
+	// only compacted by the test
+	store, walDir, dir := testPebbleKVStore(t, WithDeleteRangeCompaction(^uint64(0), 0))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	c := store.compactor
+	c.span = 500
+
+	storeBigLogs(t, store, 1, 4000)
+	assert.Nil(t, store.db.Flush())
+	before := logsDiskUsage(t, store)
+
+	// a wide suffix truncation is clamped to the last index
+	assert.Nil(t, store.DeleteRange(2001, 1<<40))
+	assert.Equal(t, uint64(2001), c.lo)
+	assert.Equal(t, uint64(4000), c.hi)
+	assert.Nil(t, store.compactLogs(c.lo, c.hi))
+	st := store.CompactionStats()
+	assert.Equal(t, uint64(1), st.Compactions)
+	assert.True(t, st.ReclaimedBytes > 1500*4096, "reclaimed %d", st.ReclaimedBytes)
+	after := logsDiskUsage(t, store)
+	assert.True(t, after < before*3/4, "disk usage %d, before %d", after, before)
+
+	// stops at the next span once closing
+	assert.Nil(t, store.life.beginClose())
+	err := store.compactLogs(1, 1000)
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, uint64(1), store.CompactionStats().Compactions)
+}
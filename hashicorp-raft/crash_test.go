@@ -0,0 +1,288 @@
+package raftpebble
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+)
+
+var (
+	crashKeyCurrentTerm  = []byte("CurrentTerm")
+	crashKeyLastVoteTerm = []byte("LastVoteTerm")
+)
+
+// crashState is the expected raft log and stable state after an op
+type crashState struct {
+	logs     map[uint64]string
+	first    uint64
+	last     uint64
+	term     uint64
+	voteTerm uint64
+}
+
+func (s *crashState) clone() *crashState {
+	c := *s
+	c.logs = make(map[uint64]string, len(s.logs))
+	for k, v := range s.logs {
+		c.logs[k] = v
+	}
+	return &c
+}
+
+// crashHarness randomly interleaves store ops on a strict mem fs,
+// simulates crashes which drop all unsynced writes, reopens the store
+// and checks the recovered state is the state after some op since last sync.
+type crashHarness struct {
+	t     testing.TB
+	rng   *rand.Rand
+	fs    *vfs.MemFS
+	opts  []Option
+	store *PebbleKVStore
+
+	// states since the last sync point, states[0] is synced
+	states []*crashState
+	ops    int
+}
+
+func newCrashHarness(t testing.TB, seed int64, opts ...Option) *crashHarness {
+	h := &crashHarness{
+		t:   t,
+		rng: rand.New(rand.NewSource(seed)),
+		fs:  vfs.NewStrictMem(),
+		opts: append([]Option{
+			WithDbDirPath("raft-pebble"),
+			WithLogger(crashLogger{}),
+		}, opts...),
+		states: []*crashState{{logs: map[uint64]string{}}},
+	}
+
+	// pebble doesn't sync the parent of db dir, do it before the first crash
+	if err := h.fs.MkdirAll("raft-pebble", 0755); err != nil {
+		t.Fatalf("mkdir err: %s", err)
+	}
+	root, err := h.fs.OpenDir("")
+	if err != nil {
+		t.Fatalf("open dir err: %s", err)
+	}
+	if err = FirstError(root.Sync(), root.Close()); err != nil {
+		t.Fatalf("sync dir err: %s", err)
+	}
+
+	h.open()
+	return h
+}
+
+// crashLogger drops pebble info logs
+type crashLogger struct{}
+
+func (crashLogger) Infof(format string, args ...interface{}) {}
+func (crashLogger) Fatalf(format string, args ...interface{}) {
+	panic(fmt.Sprintf(format, args...))
+}
+
+func (h *crashHarness) open() {
+	store, err := New(append([]Option{WithFS(h.fs)}, h.opts...)...)
+	if err != nil {
+		h.t.Fatalf("open err: %s", err)
+	}
+	h.store = store
+}
+
+func (h *crashHarness) close() {
+	if err := h.store.Close(); err != nil {
+		h.t.Fatalf("close err: %s", err)
+	}
+}
+
+func (h *crashHarness) current() *crashState {
+	return h.states[len(h.states)-1]
+}
+
+// step runs a random op and records the expected state
+func (h *crashHarness) step() {
+	h.ops++
+	s := h.current().clone()
+	switch n := h.rng.Intn(10); {
+	case n < 5:
+		h.storeLogs(s)
+	case n < 7:
+		h.deleteRange(s)
+	case n < 9:
+		h.setTerm(s)
+	default:
+		h.sync()
+		return
+	}
+	h.states = append(h.states, s)
+}
+
+func (h *crashHarness) storeLogs(s *crashState) {
+	start := s.last + 1
+	if len(s.logs) == 0 {
+		start = s.last + uint64(h.rng.Intn(3)) + 1
+		s.first = start
+	}
+	logs := make([]*raft.Log, 1+h.rng.Intn(5))
+	for i := range logs {
+		idx := start + uint64(i)
+		data := fmt.Sprintf("op%d-log%d", h.ops, idx)
+		logs[i] = &raft.Log{Index: idx, Term: s.term, Data: []byte(data)}
+		s.logs[idx] = data
+	}
+	s.last = logs[len(logs)-1].Index
+
+	if err := h.store.StoreLogs(logs); err != nil {
+		h.t.Fatalf("op %d StoreLogs err: %s", h.ops, err)
+	}
+}
+
+// deleteRange truncates a random prefix or suffix like raft compaction/conflicts
+func (h *crashHarness) deleteRange(s *crashState) {
+	if len(s.logs) == 0 {
+		return
+	}
+	k := s.first + uint64(h.rng.Int63n(int64(s.last-s.first+1)))
+	min, max := s.first, k
+	if h.rng.Intn(2) == 0 {
+		min, max = k, s.last
+	}
+	for i := min; i <= max; i++ {
+		delete(s.logs, i)
+	}
+	switch {
+	case len(s.logs) == 0:
+		// keep last to append after it like raft after snapshot restore
+	case min == s.first:
+		s.first = max + 1
+	default:
+		s.last = min - 1
+	}
+
+	if err := h.store.DeleteRange(min, max); err != nil {
+		h.t.Fatalf("op %d DeleteRange(%d,%d) err: %s", h.ops, min, max, err)
+	}
+}
+
+// setTerm sets term then vote like raft election, as two writes
+func (h *crashHarness) setTerm(s *crashState) {
+	s.term++
+	if err := h.store.SetUint64(crashKeyCurrentTerm, s.term); err != nil {
+		h.t.Fatalf("op %d SetUint64 err: %s", h.ops, err)
+	}
+	if h.rng.Intn(2) == 0 {
+		// a crash may recover the state between the two writes
+		h.states = append(h.states, s.clone())
+		s.voteTerm = s.term
+		if err := h.store.SetUint64(crashKeyLastVoteTerm, s.voteTerm); err != nil {
+			h.t.Fatalf("op %d SetUint64 err: %s", h.ops, err)
+		}
+	}
+}
+
+// sync makes all writes durable, the current state becomes the synced state
+func (h *crashHarness) sync() {
+	if err := h.store.db.LogData(nil, pebble.Sync); err != nil {
+		h.t.Fatalf("op %d sync err: %s", h.ops, err)
+	}
+	h.states = []*crashState{h.current()}
+}
+
+// crash drops unsynced writes, reopens the store and checks invariants
+func (h *crashHarness) crash() {
+	h.fs.SetIgnoreSyncs(true)
+	h.close()
+	h.fs.ResetToSyncedState()
+	h.fs.SetIgnoreSyncs(false)
+	h.open()
+
+	got := h.read()
+	synced := h.states[0]
+	if got.term < synced.term || got.voteTerm < synced.voteTerm {
+		h.t.Fatalf("op %d term/vote regress: got %d/%d synced %d/%d",
+			h.ops, got.term, got.voteTerm, synced.term, synced.voteTerm)
+	}
+	for i := len(h.states) - 1; i >= 0; i-- {
+		if h.match(got, h.states[i]) {
+			h.states = []*crashState{h.states[i]}
+			return
+		}
+	}
+	h.t.Fatalf("op %d recovered state matches no state since last sync: %+v", h.ops, got)
+}
+
+// read reads the state from the store, checking the log is contiguous
+func (h *crashHarness) read() *crashState {
+	s := &crashState{logs: map[uint64]string{}}
+	var err error
+	if s.term, err = h.store.GetUint64(crashKeyCurrentTerm); err != nil && err != ErrKeyNotFound {
+		h.t.Fatalf("op %d GetUint64 err: %s", h.ops, err)
+	}
+	if s.voteTerm, err = h.store.GetUint64(crashKeyLastVoteTerm); err != nil && err != ErrKeyNotFound {
+		h.t.Fatalf("op %d GetUint64 err: %s", h.ops, err)
+	}
+	if h.store.isEmptyLog() {
+		return s
+	}
+	if s.first, err = h.store.FirstIndex(); err != nil {
+		h.t.Fatalf("op %d FirstIndex err: %s", h.ops, err)
+	}
+	if s.last, err = h.store.LastIndex(); err != nil {
+		h.t.Fatalf("op %d LastIndex err: %s", h.ops, err)
+	}
+	for i := s.first; i <= s.last; i++ {
+		log := new(raft.Log)
+		if err := h.store.GetLog(i, log); err != nil {
+			h.t.Fatalf("op %d log not contiguous [%d,%d], GetLog(%d) err: %s",
+				h.ops, s.first, s.last, i, err)
+		}
+		s.logs[i] = string(log.Data)
+	}
+	return s
+}
+
+func (h *crashHarness) match(got, want *crashState) bool {
+	if got.term != want.term || got.voteTerm != want.voteTerm || len(got.logs) != len(want.logs) {
+		return false
+	}
+	for k, v := range want.logs {
+		if got.logs[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// run runs ops random ops with crashes at random points
+func (h *crashHarness) run(ops int, crashProb float64) {
+	for i := 0; i < ops; i++ {
+		h.step()
+		if h.rng.Float64() < crashProb {
+			h.crash()
+		}
+	}
+	h.crash()
+	h.close()
+}
+
+func TestPebbleKVStore_Crash(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			newCrashHarness(t, seed).run(300, 0.05)
+		})
+	}
+}
+
+func TestPebbleKVStore_Crash_SmallMemTable(t *testing.T) {
+	// flush memtables often to crash around flushes and WAL rotations
+	config := GetDefaultRaftLogRocksDBConfig()
+	config.KVWriteBufferSize = 16 * 1024
+	for seed := int64(0); seed < 5; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			newCrashHarness(t, seed, WithConfig(config)).run(500, 0.02)
+		})
+	}
+}
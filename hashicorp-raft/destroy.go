@@ -0,0 +1,179 @@
+package raftpebble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/go-hclog"
+)
+
+// ErrStoreLocked is an error indicating the store dir is opened,
+// by this process or another one
+var ErrStoreLocked = errors.New("pebble store locked")
+
+// Destroy removes the store of the options, eg: the node is removed from the cluster,
+// so it can rejoin with a new store: the db dir, the WAL dir, and the WAL files of
+// the WithWALFailover secondary dir, which is kept as it may be a shared mount,
+// the files are removed on the WithFS or pebble options FS.
+// notice: the store must be closed, return ErrStoreLocked if any process holds
+// the pebble LOCK of the db dir, which the open store holds for all its dirs.
+func Destroy(options ...Option) (err error) {
+	o := getOptions(options...)
+	fs, dir, walDir := o.fs, o.dir, o.walDir
+	if o.pebbleOptions != nil {
+		fs, walDir = o.pebbleOptions.FS, o.pebbleOptions.WALDir
+	}
+	if fs == nil {
+		fs = vfs.Default
+	}
+
+	if _, err = fs.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return destroyWALs(fs, dir, walDir, o.walSecondaryDir)
+	} else if err != nil {
+		return
+	}
+
+	lock, err := pebble.LockDirectory(dir, fs)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrStoreLocked, dir, err)
+	}
+	// hold the lock while removing, so no one opens the store in between
+	defer func() {
+		err = FirstError(err, lock.Close())
+	}()
+
+	if err = destroyWALs(fs, dir, walDir, o.walSecondaryDir); err != nil {
+		return
+	}
+	return fs.RemoveAll(dir)
+}
+
+// destroyWALs removes walDir if not the db dir, and the WAL files of secondary
+func destroyWALs(fs vfs.FS, dir, walDir, secondary string) error {
+	if walDir != "" && walDir != dir {
+		if err := fs.RemoveAll(walDir); err != nil {
+			return err
+		}
+	}
+	if secondary == "" {
+		return nil
+	}
+	ls, err := fs.List(secondary)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, name := range ls {
+		if strings.HasSuffix(name, walFileSuffix) || name == walProbeFile {
+			if err = fs.Remove(fs.PathJoin(secondary, name)); err != nil {
+				return err
+			}
+		}
+	}
+	// the removals are durable, so a crash doesn't bring them back
+	d, err := fs.OpenDir(secondary)
+	if err != nil {
+		return err
+	}
+	return FirstError(d.Sync(), d.Close())
+}
+
+// Reset deletes all the logs, stable keys, app keys with the applied index,
+// and the store metadata except the format version in one synced batch,
+// eg: the node is removed from the cluster, so it can rejoin with an empty state,
+// the wiped ranges are compacted to reclaim the disk space.
+// if keepIdentity, the store id and the bound identity are kept,
+// else a new store id is created and the identity is unbound.
+// notice: raft and the FSM must not use the store during Reset
+func (s *PebbleKVStore) Reset(keepIdentity bool) (err error) {
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
+	if err = s.failure(); err != nil {
+		return
+	}
+
+	id, err := s.Identity()
+	if err != nil {
+		return
+	}
+	storeID := s.storeID
+	if !keepIdentity {
+		id = Identity{}
+		if storeID, err = newUUID(); err != nil {
+			return
+		}
+	}
+
+	wb := s.db.NewBatch()
+	defer func() {
+		err = FirstError(err, wb.Close())
+	}()
+	// all the namespaces, eg: the applied index and log summaries too
+	if err = wb.DeleteRange(prefixLog, appUpperBound, nil); err != nil {
+		return
+	}
+	// only the format version and store id are kept of the meta,
+	// the sets are after the range deletion in the batch, so they win
+	var version [8]byte
+	binary.BigEndian.PutUint64(version[:], s.formatVersion)
+	if err = wb.Set(formatVersionKey, version[:], nil); err != nil {
+		return
+	}
+	if err = wb.Set(storeIDKey, []byte(storeID), nil); err != nil {
+		return
+	}
+	for _, f := range []struct {
+		key []byte
+		val string
+	}{
+		{clusterIDKey, id.ClusterID},
+		{serverIDKey, id.ServerID},
+	} {
+		if f.val == "" {
+			continue
+		}
+		if err = wb.Set(encodeStableKey(nil, f.key), []byte(f.val), nil); err != nil {
+			return
+		}
+	}
+
+	if err = s.applyReset(wb); err != nil {
+		return
+	}
+	s.storeID = storeID
+	if err = s.db.Compact(prefixLog, appUpperBound, true); err != nil {
+		return
+	}
+	if s.quota != nil {
+		s.refreshQuota()
+	}
+	s.logEvent(hclog.Info, "store reset", "storeID", storeID, "keepIdentity", keepIdentity)
+
+	return
+}
+
+// applyReset syncs the reset batch, and drops the log summaries with it
+func (s *PebbleKVStore) applyReset(wb *pebble.Batch) error {
+	if s.stats == nil {
+		return s.db.Apply(wb, pebble.Sync)
+	}
+	s.stats.writeMu.Lock()
+	defer s.stats.writeMu.Unlock()
+	if err := s.db.Apply(wb, pebble.Sync); err != nil {
+		return err
+	}
+	s.stats.mu.Lock()
+	s.stats.ranges = make(map[uint64]*LogStats)
+	s.stats.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,181 @@
+package raftpebble
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDestroy(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	id := store.StoreID()
+	assert.NoError(t, store.StoreLog(&raft.Log{Index: 1, Data: []byte("data")}))
+
+	// the open store holds the lock
+	assert.ErrorIs(t, Destroy(WithDbDirPath(dir), WithWalDirPath(walDir)), ErrStoreLocked)
+	_, err := os.Stat(dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Close())
+	assert.NoError(t, Destroy(WithDbDirPath(dir), WithWalDirPath(walDir)))
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(walDir)
+	assert.True(t, os.IsNotExist(err))
+	// already destroyed
+	assert.NoError(t, Destroy(WithDbDirPath(dir), WithWalDirPath(walDir)))
+
+	// a new store
+	store, err = New(WithDbDirPath(dir), WithWalDirPath(walDir))
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NotEqual(t, id, store.StoreID())
+	last, err := store.LastIndex()
+	assert.NoError(t, err)
+	assert.Zero(t, last)
+}
+
+func TestDestroy_WALFailover(t *testing.T) {
+	mem := walTestFS(t, "db", "wal2")
+	opts := []Option{
+		WithFS(mem),
+		WithDbDirPath("db"),
+		WithLogger(crashLogger{}),
+		WithWALFailover("wal2", time.Second, nil),
+	}
+	store, err := New(opts...)
+	assert.NoError(t, err)
+	id := store.StoreID()
+
+	// the logs in a secondary WAL file
+	store.event.onWALSlow("db/000002.log", time.Second)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(walFiles(t, mem, "wal2")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no WAL file in the secondary dir")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		assert.NoError(t, store.StoreLog(&raft.Log{Index: i, Data: []byte("data")}))
+	}
+	crashWAL(t, mem, store)
+
+	assert.NoError(t, Destroy(opts...))
+	assert.Empty(t, walFiles(t, mem, "wal2"))
+	store, err = New(opts...)
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, store.StoreID())
+	last, err := store.LastIndex()
+	assert.NoError(t, err)
+	assert.Zero(t, last)
+	assert.NoError(t, store.Close())
+
+	// a store dir removed without the secondary WAL files can't be opened
+	f, err := mem.Create("wal2/000009.log")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.NoError(t, mem.RemoveAll("db"))
+	_, err = New(opts...)
+	assert.ErrorIs(t, err, ErrOrphanWAL)
+	assert.NoError(t, Destroy(opts...))
+	store, err = New(opts...)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+}
+
+func testResetStore(t *testing.T, store *PebbleKVStore, first uint64) {
+	for i := first; i < first+10; i++ {
+		assert.NoError(t, store.StoreLog(&raft.Log{Index: i, Data: []byte("data")}))
+	}
+	assert.NoError(t, store.SetUint64([]byte("CurrentTerm"), 2))
+	assert.NoError(t, store.App().Set([]byte("k"), []byte("v")))
+	assert.NoError(t, store.App().SetAppliedIndex(first+9))
+}
+
+func testResetEmpty(t *testing.T, store *PebbleKVStore) {
+	first, err := store.FirstIndex()
+	assert.NoError(t, err)
+	assert.Zero(t, first)
+	last, err := store.LastIndex()
+	assert.NoError(t, err)
+	assert.Zero(t, last)
+	assert.True(t, store.isEmptyLog())
+	_, err = store.GetUint64([]byte("CurrentTerm"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = store.App().Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	applied, err := store.App().AppliedIndex()
+	assert.NoError(t, err)
+	assert.Zero(t, applied)
+	assert.Equal(t, LogStats{}, store.LogStats())
+
+	// only the format version and store id are kept of the meta
+	iter := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte{prefixMetaByte},
+		UpperBound: []byte{prefixAppByte},
+	})
+	var keys [][]byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+	}
+	assert.NoError(t, iter.Close())
+	assert.ElementsMatch(t, [][]byte{formatVersionKey, storeIDKey}, keys)
+	version, found, err := store.readFormatVersion()
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, formatVersion, version)
+}
+
+func TestPebbleKVStore_Reset(t *testing.T) {
+	id := Identity{ClusterID: "cluster1", ServerID: "node1"}
+	store, walDir, dir := testPebbleKVStore(t, WithExpectedIdentity(id), WithLogStats(0))
+	defer func() {
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	storeID := store.StoreID()
+
+	testResetStore(t, store, 1)
+	assert.NoError(t, store.Reset(true))
+	testResetEmpty(t, store)
+	assert.Equal(t, storeID, store.StoreID())
+	bound, err := store.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, id, bound)
+
+	// the log restarts from any index
+	assert.NoError(t, store.StoreLog(&raft.Log{Index: 100, Data: []byte("data")}))
+	assert.Equal(t, uint64(1), store.LogStats().Entries)
+
+	// kept across reopen
+	store = reopenTestPebbleKVStore(t, store, WithExpectedIdentity(id), WithLogStats(0))
+	assert.Equal(t, storeID, store.StoreID())
+	first, err := store.FirstIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), first)
+
+	testResetStore(t, store, 101)
+	assert.NoError(t, store.Reset(false))
+	testResetEmpty(t, store)
+	assert.NotEqual(t, storeID, store.StoreID())
+	bound, err = store.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{}, bound)
+
+	newID := store.StoreID()
+	store = reopenTestPebbleKVStore(t, store, WithLogStats(0))
+	assert.Equal(t, newID, store.StoreID())
+	testResetEmpty(t, store)
+	assert.NoError(t, store.Close())
+
+	assert.ErrorIs(t, store.Reset(true), ErrClosed)
+}
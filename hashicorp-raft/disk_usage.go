@@ -0,0 +1,135 @@
+package raftpebble
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// ErrQuotaExceeded is an error indicating the log write would exceed the disk quota,
+// the application should snapshot and truncate the logs.
+var ErrQuotaExceeded = errors.New("disk quota exceeded")
+
+// quotaRefreshInterval is the max age of the disk usage checked by the quota
+const quotaRefreshInterval = 100 * time.Millisecond
+
+// DiskUsage is the disk space used by the store
+type DiskUsage struct {
+	// sst bytes of the namespaces, estimated by the sstables overlapping them,
+	// a sstable across namespaces is counted in each, memtables are not counted.
+	LogBytes    uint64
+	StableBytes uint64
+	MetaBytes   uint64
+	AppBytes    uint64
+
+	// SSTBytes are all sstables, including the obsolete ones not deleted yet
+	SSTBytes uint64
+	// WALBytes are all WAL files, including the obsolete ones not deleted yet
+	WALBytes uint64
+	// ManifestBytes are the MANIFEST and OPTIONS files
+	ManifestBytes uint64
+	// CompactingBytes are the outputs of the in progress compactions
+	CompactingBytes uint64
+}
+
+// Total returns the disk space used by the store
+func (u DiskUsage) Total() uint64 {
+	return u.SSTBytes + u.WALBytes + u.ManifestBytes + u.CompactingBytes
+}
+
+// DiskUsage returns the disk space used by the store, split by namespace
+func (s *PebbleKVStore) DiskUsage() (u DiskUsage, err error) {
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
+	m := s.db.Metrics()
+	for _, l := range m.Levels {
+		u.SSTBytes += uint64(l.Size)
+	}
+	u.SSTBytes += m.Table.ObsoleteSize + m.Table.ZombieSize
+	u.WALBytes = m.WAL.PhysicalSize + m.WAL.ObsoletePhysicalSize
+	u.CompactingBytes = uint64(m.Compact.InProgressBytes)
+	// the rest of DiskSpaceUsage is the MANIFEST and OPTIONS files
+	if total := m.DiskSpaceUsage(); total > u.Total() {
+		u.ManifestBytes = total - u.Total()
+	}
+
+	for _, ns := range []struct {
+		bytes *uint64
+		start byte
+	}{
+		{&u.LogBytes, prefixLogByte},
+		{&u.StableBytes, prefixConfByte},
+		{&u.MetaBytes, prefixMetaByte},
+		{&u.AppBytes, prefixAppByte},
+	} {
+		if *ns.bytes, err = s.db.EstimateDiskUsage([]byte{ns.start}, []byte{ns.start + 1}); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// quota rejects the log writes past max disk bytes,
+// the disk usage is refreshed every quotaRefreshInterval,
+// and the bytes written since are added to it.
+type quota struct {
+	max        uint64
+	onExceeded func(DiskUsage)
+
+	mu        sync.Mutex
+	usage     uint64
+	written   uint64
+	refreshed time.Time
+	// onExceeded is called once until the usage is under the quota again
+	exceeded bool
+}
+
+// reserveQuota checks size bytes can be written under the quota
+func (s *PebbleKVStore) reserveQuota(size uint64) error {
+	q := s.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if time.Since(q.refreshed) >= quotaRefreshInterval {
+		m := s.db.Metrics()
+		q.usage, q.written, q.refreshed = m.DiskSpaceUsage(), 0, time.Now()
+	}
+	if q.usage+q.written+size <= q.max {
+		q.written += size
+		q.exceeded = false
+		return nil
+	}
+
+	if !q.exceeded && q.onExceeded != nil {
+		s.event.stopper.RunWorker(func() {
+			if s.failure() != nil {
+				return
+			}
+			u, err := s.DiskUsage()
+			if err != nil {
+				s.logEvent(hclog.Warn, "disk usage failed", "error", err)
+				return
+			}
+			q.onExceeded(u)
+		})
+	}
+	q.exceeded = true
+
+	return ErrQuotaExceeded
+}
+
+// refreshQuota forces the next reserve to refresh the disk usage,
+// eg: after the logs truncated.
+func (s *PebbleKVStore) refreshQuota() {
+	q := s.quota
+	q.mu.Lock()
+	q.refreshed = time.Time{}
+	q.mu.Unlock()
+}
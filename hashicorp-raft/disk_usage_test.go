@@ -0,0 +1,100 @@
+package raftpebble
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPebbleKVStore_DiskUsage(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	storeBigLogs(t, store, 1, 1000)
+	assert.Nil(t, store.SetUint64([]byte("CurrentTerm"), 1))
+	assert.Nil(t, store.App().Set([]byte("state"), make([]byte, 1024)))
+	assert.Nil(t, store.db.Flush())
+
+	u, err := store.DiskUsage()
+	assert.Nil(t, err)
+	assert.True(t, u.LogBytes > 1000*4096, "log bytes %d", u.LogBytes)
+	assert.True(t, u.StableBytes < u.LogBytes)
+	assert.True(t, u.AppBytes < u.LogBytes)
+	assert.True(t, u.SSTBytes >= u.LogBytes)
+	assert.True(t, u.WALBytes > 0)
+	assert.True(t, u.ManifestBytes > 0)
+	assert.Equal(t, store.db.Metrics().DiskSpaceUsage(), u.Total())
+}
+
+func TestPebbleKVStore_DiskQuota(t *testing.T) {
+	exceeded := make(chan DiskUsage, 10)
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	u, err := store.DiskUsage()
+	assert.Nil(t, err)
+	max := u.Total() + 1<<20
+	store = reopenTestPebbleKVStore(t, store, WithDiskQuota(max, func(u DiskUsage) {
+		exceeded <- u
+	}))
+	defer store.Close()
+
+	// writes until the quota
+	var index uint64
+	var written int
+	for ; written < 4<<20; written += 16 * 4096 {
+		logs := make([]*raft.Log, 16)
+		for i := range logs {
+			index++
+			logs[i] = &raft.Log{Index: index, Term: 1, Data: make([]byte, 4096)}
+		}
+		if err = store.StoreLogs(logs); err != nil {
+			index -= 16
+			break
+		}
+	}
+	assert.True(t, errors.Is(err, ErrQuotaExceeded), "err %v", err)
+	assert.True(t, written <= 1<<20, "written %d", written)
+
+	// the callback is called once with the usage
+	select {
+	case u := <-exceeded:
+		assert.True(t, u.Total() > 0)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("quota callback not called")
+	}
+	err = store.StoreLog(&raft.Log{Index: index + 1, Data: make([]byte, 1<<20)})
+	assert.True(t, errors.Is(err, ErrQuotaExceeded), "err %v", err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, exceeded)
+
+	// the stable store and truncation are never rejected
+	assert.Nil(t, store.SetUint64([]byte("CurrentTerm"), 2))
+	assert.Nil(t, store.DeleteRange(1, index))
+
+	// a txn appending logs is rejected, a stable only one is not
+	txn := store.NewTxn()
+	assert.Nil(t, txn.StoreLog(&raft.Log{Index: index + 1, Data: make([]byte, 1<<20)}))
+	assert.True(t, errors.Is(txn.Commit(), ErrQuotaExceeded))
+	txn = store.NewTxn()
+	assert.Nil(t, txn.SetUint64([]byte("CurrentTerm"), 3))
+	assert.Nil(t, txn.Commit())
+
+	// the truncated logs are reclaimed for the application to write again,
+	// recycled WAL files are still counted in the disk usage
+	assert.Nil(t, store.db.Flush())
+	assert.Nil(t, store.db.Compact(prefixLog, prefixConf, true))
+	u, err = store.DiskUsage()
+	assert.Nil(t, err)
+	assert.True(t, u.LogBytes < 4096, "log bytes %d", u.LogBytes)
+}
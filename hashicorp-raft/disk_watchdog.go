@@ -0,0 +1,112 @@
+package raftpebble
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/go-hclog"
+)
+
+// ErrLowDiskSpace is an error indicating the store rejects writes,
+// as the free space of the db or WAL dir is below the watchdog threshold.
+var ErrLowDiskSpace = errors.New("low disk space")
+
+// DiskSpaceState is the low disk watchdog state of the fullest store dir
+type DiskSpaceState struct {
+	Low        bool
+	Dir        string
+	AvailBytes uint64
+	TotalBytes uint64
+}
+
+// diskWatchdog monitors the free space of the store dirs,
+// it turns low below minFree, and back above minFree plus 10%,
+// so the state doesn't flap around the threshold.
+type diskWatchdog struct {
+	fs       vfs.FS
+	dirs     []string
+	minFree  uint64
+	interval time.Duration
+	onChange func(DiskSpaceState)
+
+	low int32
+}
+
+// LowDiskSpace returns true if the store rejects writes for low disk space,
+// notice: false if not enabled with WithLowDiskWatchdog
+func (s *PebbleKVStore) LowDiskSpace() bool {
+	return s.watchdog != nil && atomic.LoadInt32(&s.watchdog.low) == 1
+}
+
+// checkDiskSpace returns ErrLowDiskSpace in the reject-writes mode
+func (s *PebbleKVStore) checkDiskSpace() error {
+	if s.LowDiskSpace() {
+		return ErrLowDiskSpace
+	}
+	return nil
+}
+
+// runDiskWatchdog checks the disk space every interval until stop
+func (s *PebbleKVStore) runDiskWatchdog() {
+	w := s.watchdog
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkDiskWatchdog()
+		case <-s.event.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+// checkDiskWatchdog checks the fullest dir and flips the state
+func (s *PebbleKVStore) checkDiskWatchdog() {
+	w := s.watchdog
+	var st DiskSpaceState
+	for i, dir := range w.dirs {
+		u, err := w.fs.GetDiskUsage(dir)
+		if err != nil {
+			// keep the state, the dir may be unavailable for a moment
+			s.logEvent(hclog.Warn, "get disk usage failed", "dir", dir, "error", err)
+			return
+		}
+		if i == 0 || u.AvailBytes < st.AvailBytes {
+			st.Dir, st.AvailBytes, st.TotalBytes = dir, u.AvailBytes, u.TotalBytes
+		}
+	}
+
+	wasLow := atomic.LoadInt32(&w.low) == 1
+	st.Low = st.AvailBytes < w.minFree
+	if wasLow && !st.Low {
+		st.Low = st.AvailBytes < w.minFree+w.minFree/10
+	}
+
+	metrics.SetGauge([]string{"raft", "pebble", "disk", "availBytes"}, float32(st.AvailBytes))
+	var low float32
+	if st.Low {
+		low = 1
+	}
+	metrics.SetGauge([]string{"raft", "pebble", "disk", "low"}, low)
+	if st.Low == wasLow {
+		return
+	}
+
+	if st.Low {
+		atomic.StoreInt32(&w.low, 1)
+		s.logEvent(hclog.Warn, "low disk space, reject writes",
+			"dir", st.Dir, "availBytes", st.AvailBytes)
+	} else {
+		atomic.StoreInt32(&w.low, 0)
+		s.logEvent(hclog.Info, "disk space recovered, accept writes",
+			"dir", st.Dir, "availBytes", st.AvailBytes)
+	}
+	if w.onChange != nil {
+		w.onChange(st)
+	}
+}
@@ -0,0 +1,133 @@
+package raftpebble
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+// diskSpaceFS reports the set available bytes of the disk
+type diskSpaceFS struct {
+	vfs.FS
+	avail uint64
+	fail  int32
+}
+
+func (fs *diskSpaceFS) GetDiskUsage(path string) (vfs.DiskUsage, error) {
+	if atomic.LoadInt32(&fs.fail) == 1 {
+		return vfs.DiskUsage{}, errors.New("unavailable")
+	}
+	return vfs.DiskUsage{
+		AvailBytes: atomic.LoadUint64(&fs.avail),
+		TotalBytes: 100 << 30,
+	}, nil
+}
+
+func (fs *diskSpaceFS) setAvail(avail uint64) {
+	atomic.StoreUint64(&fs.avail, avail)
+}
+
+type diskSpaceChanges struct {
+	mu     sync.Mutex
+	states []DiskSpaceState
+}
+
+func (c *diskSpaceChanges) add(st DiskSpaceState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states = append(c.states, st)
+}
+
+func (c *diskSpaceChanges) get() []DiskSpaceState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]DiskSpaceState(nil), c.states...)
+}
+
+func waitLowDiskSpace(t *testing.T, store *PebbleKVStore, low bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for store.LowDiskSpace() != low {
+		if time.Now().After(deadline) {
+			t.Fatalf("low disk space not %v", low)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPebbleKVStore_LowDiskWatchdog(t *testing.T) {
+	fs := &diskSpaceFS{FS: vfs.Default, avail: 10 << 30}
+	changes := &diskSpaceChanges{}
+	store, walDir, dir := testPebbleKVStore(t,
+		WithFS(fs),
+		WithLowDiskWatchdog(1<<30, 10*time.Millisecond, changes.add))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	assert.False(t, store.LowDiskSpace())
+	assert.Nil(t, store.StoreLog(&raft.Log{Index: 1}))
+
+	fs.setAvail(512 << 20)
+	waitLowDiskSpace(t, store, true)
+	err := store.StoreLog(&raft.Log{Index: 2})
+	assert.True(t, errors.Is(err, ErrLowDiskSpace), "err %v", err)
+	err = store.StoreLogs([]*raft.Log{{Index: 2}})
+	assert.True(t, errors.Is(err, ErrLowDiskSpace), "err %v", err)
+	err = store.App().Set([]byte("k"), []byte("v"))
+	assert.True(t, errors.Is(err, ErrLowDiskSpace), "err %v", err)
+	txn := store.NewTxn()
+	assert.Nil(t, txn.StoreLog(&raft.Log{Index: 2}))
+	assert.True(t, errors.Is(txn.Commit(), ErrLowDiskSpace))
+
+	// the stable store and truncation are accepted
+	assert.Nil(t, store.SetUint64([]byte("CurrentTerm"), 2))
+	assert.Nil(t, store.DeleteRange(1, 1))
+
+	// a get disk usage error keeps the state
+	atomic.StoreInt32(&fs.fail, 1)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, store.LowDiskSpace())
+	atomic.StoreInt32(&fs.fail, 0)
+
+	// not recovered right above the threshold
+	fs.setAvail(1<<30 + 1)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, store.LowDiskSpace())
+
+	fs.setAvail(2 << 30)
+	waitLowDiskSpace(t, store, false)
+	assert.Nil(t, store.StoreLog(&raft.Log{Index: 2}))
+
+	states := changes.get()
+	assert.Len(t, states, 2)
+	assert.True(t, states[0].Low)
+	assert.Equal(t, uint64(512<<20), states[0].AvailBytes)
+	assert.Equal(t, dir, states[0].Dir)
+	assert.False(t, states[1].Low)
+}
+
+func TestPebbleKVStore_LowDiskWatchdog_Open(t *testing.T) {
+	// low on open rejects the first write
+	fs := &diskSpaceFS{FS: vfs.Default, avail: 1 << 20}
+	store, walDir, dir := testPebbleKVStore(t,
+		WithFS(fs),
+		WithLowDiskWatchdog(1<<30, time.Hour, nil))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	assert.True(t, store.LowDiskSpace())
+	err := store.StoreLog(&raft.Log{Index: 1})
+	assert.True(t, errors.Is(err, ErrLowDiskSpace), "err %v", err)
+}
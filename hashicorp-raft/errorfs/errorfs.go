@@ -0,0 +1,407 @@
+// Package errorfs provides a fault injection vfs.FS for testing the
+// raftpebble store error paths, eg: EIO, ENOSPC.
+// like pebble internal/errorfs, which can't be imported.
+//
+//	inj, _ := errorfs.NewInject(errorfs.Config{Ops: errorfs.WriteOps, Err: syscall.ENOSPC})
+//	store, _ := raftpebble.New(raftpebble.WithFS(errorfs.Wrap(vfs.Default, inj)), ...)
+//	inj.Enable()
+package errorfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// ErrInjected is the default error injected
+var ErrInjected = errors.New("injected error")
+
+// Op is the type of fs operation
+type Op int
+
+const (
+	OpCreate Op = iota
+	OpLink
+	OpOpen
+	OpOpenDir
+	OpRemove
+	OpRemoveAll
+	OpRename
+	OpReuseForWrite
+	OpMkdirAll
+	OpLock
+	OpList
+	OpStat
+	OpGetDiskUsage
+	OpFileClose
+	OpFileRead
+	OpFileReadAt
+	OpFileWrite
+	OpFileStat
+	OpFileSync
+	OpFilePreallocate
+)
+
+var opNames = [...]string{
+	OpCreate:          "create",
+	OpLink:            "link",
+	OpOpen:            "open",
+	OpOpenDir:         "open-dir",
+	OpRemove:          "remove",
+	OpRemoveAll:       "remove-all",
+	OpRename:          "rename",
+	OpReuseForWrite:   "reuse-for-write",
+	OpMkdirAll:        "mkdir-all",
+	OpLock:            "lock",
+	OpList:            "list",
+	OpStat:            "stat",
+	OpGetDiskUsage:    "get-disk-usage",
+	OpFileClose:       "file-close",
+	OpFileRead:        "file-read",
+	OpFileReadAt:      "file-read-at",
+	OpFileWrite:       "file-write",
+	OpFileStat:        "file-stat",
+	OpFileSync:        "file-sync",
+	OpFilePreallocate: "file-preallocate",
+}
+
+func (o Op) String() string {
+	if o < 0 || int(o) >= len(opNames) {
+		return fmt.Sprintf("op(%d)", int(o))
+	}
+	return opNames[o]
+}
+
+var (
+	// ReadOps are the ops which read data or metadata
+	ReadOps = []Op{OpOpen, OpOpenDir, OpList, OpStat, OpGetDiskUsage,
+		OpFileRead, OpFileReadAt, OpFileStat}
+	// WriteOps are the ops which modify data or metadata
+	WriteOps = []Op{OpCreate, OpLink, OpRemove, OpRemoveAll, OpRename, OpReuseForWrite,
+		OpMkdirAll, OpLock, OpFileClose, OpFileWrite, OpFileSync, OpFilePreallocate}
+)
+
+// Injector decides whether to fail an op on path
+type Injector interface {
+	MaybeError(op Op, path string) error
+}
+
+// Config configures the ops an Inject fails
+type Config struct {
+	// Ops to fail, all ops if empty
+	Ops []Op
+	// PathPattern is a regexp matched against the op path, all paths if empty
+	PathPattern string
+	// Probability to fail a matched op, 0 means always
+	Probability float64
+	// Err to inject, default ErrInjected
+	Err error
+	// Seed of the probability rand
+	Seed int64
+}
+
+// Inject is an Injector configured by Config,
+// it starts disabled so the store can be opened, Enable to start injecting.
+type Inject struct {
+	ops  map[Op]bool
+	re   *regexp.Regexp
+	prob float64
+	err  error
+
+	mu  sync.Mutex
+	rng *rand.Rand
+
+	enabled  int32
+	injected int64
+}
+
+// NewInject returns a disabled Inject for the config
+func NewInject(cfg Config) (*Inject, error) {
+	inj := &Inject{
+		prob: cfg.Probability,
+		err:  cfg.Err,
+		rng:  rand.New(rand.NewSource(cfg.Seed)),
+	}
+	if inj.err == nil {
+		inj.err = ErrInjected
+	}
+	if len(cfg.Ops) > 0 {
+		inj.ops = make(map[Op]bool, len(cfg.Ops))
+		for _, op := range cfg.Ops {
+			inj.ops[op] = true
+		}
+	}
+	if cfg.PathPattern != "" {
+		re, err := regexp.Compile(cfg.PathPattern)
+		if err != nil {
+			return nil, err
+		}
+		inj.re = re
+	}
+
+	return inj, nil
+}
+
+// Enable starts injecting errors
+func (i *Inject) Enable() {
+	atomic.StoreInt32(&i.enabled, 1)
+}
+
+// Disable stops injecting errors
+func (i *Inject) Disable() {
+	atomic.StoreInt32(&i.enabled, 0)
+}
+
+// Injected returns the number of injected errors
+func (i *Inject) Injected() int64 {
+	return atomic.LoadInt64(&i.injected)
+}
+
+// MaybeError implements Injector
+func (i *Inject) MaybeError(op Op, path string) error {
+	if atomic.LoadInt32(&i.enabled) == 0 {
+		return nil
+	}
+	if i.ops != nil && !i.ops[op] {
+		return nil
+	}
+	if i.re != nil && !i.re.MatchString(path) {
+		return nil
+	}
+	if i.prob > 0 {
+		i.mu.Lock()
+		skip := i.rng.Float64() >= i.prob
+		i.mu.Unlock()
+		if skip {
+			return nil
+		}
+	}
+
+	atomic.AddInt64(&i.injected, 1)
+	return fmt.Errorf("errorfs: %s %s: %w", op, path, i.err)
+}
+
+// FS is a vfs.FS which fails ops chosen by the Injector
+type FS struct {
+	fs  vfs.FS
+	inj Injector
+}
+
+var _ vfs.FS = (*FS)(nil)
+
+// Wrap wraps the fs with error injection
+func Wrap(fs vfs.FS, inj Injector) *FS {
+	return &FS{
+		fs:  fs,
+		inj: inj,
+	}
+}
+
+// Unwrap returns the wrapped fs
+func (fs *FS) Unwrap() vfs.FS {
+	return fs.fs
+}
+
+func (fs *FS) wrapFile(name string, f vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &errorFile{name: name, file: f, inj: fs.inj}, nil
+}
+
+func (fs *FS) Create(name string) (vfs.File, error) {
+	if err := fs.inj.MaybeError(OpCreate, name); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.Create(name)
+	return fs.wrapFile(name, f, err)
+}
+
+func (fs *FS) Link(oldname, newname string) error {
+	if err := fs.inj.MaybeError(OpLink, oldname); err != nil {
+		return err
+	}
+	return fs.fs.Link(oldname, newname)
+}
+
+func (fs *FS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	if err := fs.inj.MaybeError(OpOpen, name); err != nil {
+		return nil, err
+	}
+	// the options apply to the inner file, eg: fadvise of RandomReadsOption
+	f, err := fs.fs.Open(name, opts...)
+	return fs.wrapFile(name, f, err)
+}
+
+func (fs *FS) OpenDir(name string) (vfs.File, error) {
+	if err := fs.inj.MaybeError(OpOpenDir, name); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.OpenDir(name)
+	return fs.wrapFile(name, f, err)
+}
+
+func (fs *FS) Remove(name string) error {
+	if err := fs.inj.MaybeError(OpRemove, name); err != nil {
+		return err
+	}
+	return fs.fs.Remove(name)
+}
+
+func (fs *FS) RemoveAll(fullname string) error {
+	if err := fs.inj.MaybeError(OpRemoveAll, fullname); err != nil {
+		return err
+	}
+	return fs.fs.RemoveAll(fullname)
+}
+
+func (fs *FS) Rename(oldname, newname string) error {
+	if err := fs.inj.MaybeError(OpRename, oldname); err != nil {
+		return err
+	}
+	return fs.fs.Rename(oldname, newname)
+}
+
+func (fs *FS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	if err := fs.inj.MaybeError(OpReuseForWrite, oldname); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.ReuseForWrite(oldname, newname)
+	return fs.wrapFile(newname, f, err)
+}
+
+func (fs *FS) MkdirAll(dir string, perm os.FileMode) error {
+	if err := fs.inj.MaybeError(OpMkdirAll, dir); err != nil {
+		return err
+	}
+	return fs.fs.MkdirAll(dir, perm)
+}
+
+func (fs *FS) Lock(name string) (io.Closer, error) {
+	if err := fs.inj.MaybeError(OpLock, name); err != nil {
+		return nil, err
+	}
+	return fs.fs.Lock(name)
+}
+
+func (fs *FS) List(dir string) ([]string, error) {
+	if err := fs.inj.MaybeError(OpList, dir); err != nil {
+		return nil, err
+	}
+	return fs.fs.List(dir)
+}
+
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.inj.MaybeError(OpStat, name); err != nil {
+		return nil, err
+	}
+	return fs.fs.Stat(name)
+}
+
+func (fs *FS) PathBase(p string) string {
+	return fs.fs.PathBase(p)
+}
+
+func (fs *FS) PathJoin(elem ...string) string {
+	return fs.fs.PathJoin(elem...)
+}
+
+func (fs *FS) PathDir(p string) string {
+	return fs.fs.PathDir(p)
+}
+
+func (fs *FS) GetDiskUsage(path string) (vfs.DiskUsage, error) {
+	if err := fs.inj.MaybeError(OpGetDiskUsage, path); err != nil {
+		return vfs.DiskUsage{}, err
+	}
+	return fs.fs.GetDiskUsage(path)
+}
+
+type errorFile struct {
+	name string
+	file vfs.File
+	inj  Injector
+}
+
+func (f *errorFile) Close() error {
+	// close the file anyway to not leak fd
+	return firstError(f.inj.MaybeError(OpFileClose, f.name), f.file.Close())
+}
+
+func (f *errorFile) Read(p []byte) (int, error) {
+	if err := f.inj.MaybeError(OpFileRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+func (f *errorFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.inj.MaybeError(OpFileReadAt, f.name); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *errorFile) Write(p []byte) (int, error) {
+	if err := f.inj.MaybeError(OpFileWrite, f.name); err != nil {
+		return 0, err
+	}
+	return f.file.Write(p)
+}
+
+func (f *errorFile) Stat() (os.FileInfo, error) {
+	if err := f.inj.MaybeError(OpFileStat, f.name); err != nil {
+		return nil, err
+	}
+	return f.file.Stat()
+}
+
+func (f *errorFile) Prefetch(offset, length int64) error {
+	return f.file.Prefetch(offset, length)
+}
+
+func (f *errorFile) Preallocate(offset, length int64) error {
+	if err := f.inj.MaybeError(OpFilePreallocate, f.name); err != nil {
+		return err
+	}
+	return f.file.Preallocate(offset, length)
+}
+
+func (f *errorFile) Sync() error {
+	if err := f.inj.MaybeError(OpFileSync, f.name); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+func (f *errorFile) SyncData() error {
+	if err := f.inj.MaybeError(OpFileSync, f.name); err != nil {
+		return err
+	}
+	return f.file.SyncData()
+}
+
+func (f *errorFile) SyncTo(length int64) (fullSync bool, err error) {
+	if err := f.inj.MaybeError(OpFileSync, f.name); err != nil {
+		return false, err
+	}
+	return f.file.SyncTo(length)
+}
+
+func (f *errorFile) Fd() uintptr {
+	return f.file.Fd()
+}
+
+func firstError(err1 error, err2 error) error {
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
@@ -0,0 +1,88 @@
+package errorfs
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInject(t *testing.T) {
+	inj, err := NewInject(Config{
+		Ops:         []Op{OpCreate, OpFileWrite},
+		PathPattern: `\.log$`,
+		Err:         syscall.ENOSPC,
+	})
+	assert.Nil(t, err)
+	fs := Wrap(vfs.NewMem(), inj)
+
+	// disabled
+	f, err := fs.Create("000001.log")
+	assert.Nil(t, err)
+
+	inj.Enable()
+	_, err = f.Write([]byte("data"))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	_, err = fs.Create("000002.log")
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.EqualValues(t, 2, inj.Injected())
+
+	// not matched path or op
+	_, err = fs.Create("000003.sst")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	assert.Nil(t, f.Close())
+
+	inj.Disable()
+	_, err = fs.Create("000004.log")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, inj.Injected())
+}
+
+func TestInject_Probability(t *testing.T) {
+	inj, err := NewInject(Config{Probability: 0.5, Seed: 1})
+	assert.Nil(t, err)
+	inj.Enable()
+
+	n := 0
+	for i := 0; i < 1000; i++ {
+		if err := inj.MaybeError(OpFileRead, "000001.sst"); err != nil {
+			assert.True(t, errors.Is(err, ErrInjected))
+			n++
+		}
+	}
+	assert.True(t, n > 400 && n < 600, n)
+}
+
+func TestInject_BadPattern(t *testing.T) {
+	_, err := NewInject(Config{PathPattern: "("})
+	assert.NotNil(t, err)
+}
+
+// openFS records the options of Open
+type openFS struct {
+	vfs.FS
+	opts []vfs.OpenOption
+}
+
+func (fs *openFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	fs.opts = append(fs.opts, opts...)
+	return fs.FS.Open(name, opts...)
+}
+
+func TestFS_OpenOptions(t *testing.T) {
+	inj, err := NewInject(Config{})
+	assert.Nil(t, err)
+	inner := &openFS{FS: vfs.NewMem()}
+	f, err := inner.Create("000001.sst")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	// passed to the inner fs
+	f, err = Wrap(inner, inj).Open("000001.sst", vfs.RandomReadsOption)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.Equal(t, []vfs.OpenOption{vfs.RandomReadsOption}, inner.opts)
+}
@@ -0,0 +1,251 @@
+package raftpebble
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/weedge/raft-pebble/errorfs"
+)
+
+// testErrorFSStore opens a store on mem fs with the disabled injector
+func testErrorFSStore(t *testing.T, cfg errorfs.Config, opts ...Option) (*PebbleKVStore, *errorfs.Inject) {
+	inj, err := errorfs.NewInject(cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store, err := New(append([]Option{
+		WithFS(errorfs.Wrap(vfs.NewMem(), inj)),
+		WithDbDirPath("raft-pebble"),
+		WithLogger(crashLogger{}),
+	}, opts...)...)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return store, inj
+}
+
+func TestPebbleKVStore_ErrorFS_Open(t *testing.T) {
+	for _, op := range []errorfs.Op{errorfs.OpMkdirAll, errorfs.OpLock, errorfs.OpCreate, errorfs.OpList} {
+		t.Run(op.String(), func(t *testing.T) {
+			inj, err := errorfs.NewInject(errorfs.Config{Ops: []errorfs.Op{op}, Err: syscall.EIO})
+			assert.Nil(t, err)
+			inj.Enable()
+
+			_, err = New(
+				WithFS(errorfs.Wrap(vfs.NewMem(), inj)),
+				WithDbDirPath("raft-pebble"),
+				WithLogger(crashLogger{}),
+			)
+			assert.ErrorIs(t, err, syscall.EIO)
+		})
+	}
+}
+
+func TestPebbleKVStore_ErrorFS_Write(t *testing.T) {
+	for _, errno := range []error{syscall.EIO, syscall.ENOSPC} {
+		t.Run(errno.Error(), func(t *testing.T) {
+			store, inj := testErrorFSStore(t, errorfs.Config{
+				Ops:         errorfs.WriteOps,
+				PathPattern: `\.log$`,
+				Err:         errno,
+			}, WithSync(true))
+
+			err := store.StoreLogs([]*raft.Log{{Index: 1, Data: []byte("log1")}})
+			assert.Nil(t, err)
+			err = store.SetUint64([]byte("CurrentTerm"), 1)
+			assert.Nil(t, err)
+
+			inj.Enable()
+			err = store.StoreLogs([]*raft.Log{{Index: 2, Data: []byte("log2")}})
+			assert.ErrorIs(t, err, ErrStoreFailed)
+			assert.True(t, inj.Injected() > 0)
+
+			// the store rejects writes after a fatal error
+			inj.Disable()
+			err = store.StoreLog(&raft.Log{Index: 2})
+			assert.ErrorIs(t, err, ErrStoreFailed)
+			err = store.StoreLogs([]*raft.Log{{Index: 2}})
+			assert.ErrorIs(t, err, ErrStoreFailed)
+			err = store.DeleteRange(1, 1)
+			assert.ErrorIs(t, err, ErrStoreFailed)
+			err = store.Set([]byte("k"), []byte("v"))
+			assert.ErrorIs(t, err, ErrStoreFailed)
+			err = store.SetUint64([]byte("CurrentTerm"), 2)
+			assert.ErrorIs(t, err, ErrStoreFailed)
+
+			// reads still work
+			log := new(raft.Log)
+			err = store.GetLog(1, log)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("log1"), log.Data)
+			term, err := store.GetUint64([]byte("CurrentTerm"))
+			assert.Nil(t, err)
+			assert.EqualValues(t, 1, term)
+
+			// closed cleanly
+			assert.NotPanics(t, func() {
+				store.Close()
+			})
+		})
+	}
+}
+
+func TestPebbleKVStore_ErrorFS_EachWrite(t *testing.T) {
+	writes := map[string]func(s *PebbleKVStore) error{
+		"StoreLog": func(s *PebbleKVStore) error {
+			return s.StoreLog(&raft.Log{Index: 2})
+		},
+		"StoreLogs": func(s *PebbleKVStore) error {
+			return s.StoreLogs([]*raft.Log{{Index: 2}, {Index: 3}})
+		},
+		"DeleteRange": func(s *PebbleKVStore) error {
+			return s.DeleteRange(1, 1)
+		},
+		"Set": func(s *PebbleKVStore) error {
+			return s.Set([]byte("k"), []byte("v"))
+		},
+		"SetUint64": func(s *PebbleKVStore) error {
+			return s.SetUint64([]byte("k"), 1)
+		},
+	}
+	for name, write := range writes {
+		t.Run(name, func(t *testing.T) {
+			store, inj := testErrorFSStore(t, errorfs.Config{
+				Ops: []errorfs.Op{errorfs.OpFileWrite, errorfs.OpFileSync},
+				Err: syscall.EIO,
+			}, WithSync(true))
+			err := store.StoreLog(&raft.Log{Index: 1})
+			assert.Nil(t, err)
+
+			inj.Enable()
+			err = write(store)
+			assert.ErrorIs(t, err, ErrStoreFailed)
+
+			inj.Disable()
+			assert.NotPanics(t, func() {
+				store.Close()
+			})
+		})
+	}
+}
+
+func TestPebbleKVStore_ErrorFS_Read(t *testing.T) {
+	store, inj := testErrorFSStore(t, errorfs.Config{
+		Ops:         errorfs.ReadOps,
+		PathPattern: `\.sst$`,
+		Err:         syscall.EIO,
+	})
+	defer store.Close()
+
+	var logs []*raft.Log
+	for i := 1; i <= 10; i++ {
+		logs = append(logs, &raft.Log{Index: uint64(i), Data: []byte(fmt.Sprintf("log%d", i))})
+	}
+	err := store.StoreLogs(logs)
+	assert.Nil(t, err)
+	err = store.Set([]byte("k"), []byte("v"))
+	assert.Nil(t, err)
+	err = store.SetUint64([]byte("CurrentTerm"), 1)
+	assert.Nil(t, err)
+	// flush to sst, no block cache, so reads hit the fs
+	err = store.db.Flush()
+	assert.Nil(t, err)
+
+	inj.Enable()
+	_, err = store.FirstIndex()
+	assert.ErrorIs(t, err, syscall.EIO)
+	_, err = store.LastIndex()
+	assert.ErrorIs(t, err, syscall.EIO)
+	err = store.GetLog(5, new(raft.Log))
+	assert.ErrorIs(t, err, syscall.EIO)
+	_, err = store.Get([]byte("k"))
+	assert.ErrorIs(t, err, syscall.EIO)
+	_, err = store.GetUint64([]byte("CurrentTerm"))
+	assert.ErrorIs(t, err, syscall.EIO)
+
+	// read errors don't fail the store
+	inj.Disable()
+	err = store.GetLog(5, new(raft.Log))
+	assert.Nil(t, err)
+	err = store.StoreLog(&raft.Log{Index: 11})
+	assert.Nil(t, err)
+}
+
+func TestPebbleKVStore_ErrorFS_Probability(t *testing.T) {
+	store, inj := testErrorFSStore(t, errorfs.Config{
+		Ops:         []errorfs.Op{errorfs.OpFileWrite},
+		Probability: 0.05,
+		Seed:        1,
+	}, WithSync(true))
+
+	inj.Enable()
+	var err error
+	assert.NotPanics(t, func() {
+		for i := 1; i <= 1000 && err == nil; i++ {
+			err = store.StoreLog(&raft.Log{Index: uint64(i)})
+		}
+	})
+	assert.True(t, errors.Is(err, ErrStoreFailed))
+
+	inj.Disable()
+	assert.NotPanics(t, func() {
+		store.Close()
+	})
+}
+
+func TestPebbleKVStore_ErrorFS_CloseAfterFailure(t *testing.T) {
+	busy := make(chan bool, 100)
+	store, inj := testErrorFSStore(t, errorfs.Config{
+		Ops:         errorfs.WriteOps,
+		PathPattern: `\.log$`,
+		Err:         syscall.EIO,
+	}, WithSync(true),
+		WithDeleteRangeCompaction(1, 100*time.Millisecond),
+		WithLogDBCallback(func(b bool) {
+			select {
+			case busy <- b:
+			default:
+			}
+		}))
+	var logs []*raft.Log
+	for i := 1; i <= 10; i++ {
+		logs = append(logs, &raft.Log{Index: uint64(i)})
+	}
+	assert.Nil(t, store.StoreLogs(logs))
+	// the compactor waits the min interval with a pending span
+	assert.Nil(t, store.DeleteRange(1, 2))
+	waitCompactions(t, store, 1)
+	assert.Nil(t, store.DeleteRange(3, 4))
+
+	inj.Enable()
+	err := store.StoreLog(&raft.Log{Index: 11})
+	assert.ErrorIs(t, err, ErrStoreFailed)
+
+	// the pending compaction and the busy check skip the failed db
+	time.Sleep(200 * time.Millisecond)
+	for len(busy) > 0 {
+		<-busy
+	}
+	store.event.notify()
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 1, store.CompactionStats().Compactions)
+	assert.Equal(t, 0, len(busy))
+
+	inj.Disable()
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close hangs after the store failed")
+	}
+}
@@ -0,0 +1,263 @@
+package raftpebble
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/go-hclog"
+)
+
+// defaultEventHistory is the number of recent events kept by default
+const defaultEventHistory = 256
+
+// event types
+const (
+	EventFlush           = "flush"
+	EventCompaction      = "compaction"
+	EventIngest          = "ingest"
+	EventTableDeleted    = "table deleted"
+	EventWriteStallBegin = "write stall begin"
+	EventWriteStallEnd   = "write stall end"
+	EventManifestCreated = "manifest created"
+	EventManifestDeleted = "manifest deleted"
+	EventWALCreated      = "WAL created"
+	EventWALDeleted      = "WAL deleted"
+	EventBackgroundError = "background error"
+)
+
+// Event is a pebble event recorded with WithEventHistory
+type Event struct {
+	Type  string
+	Time  time.Time
+	JobID int
+	// Duration of the flush, compaction or write stall
+	Duration time.Duration
+	// Reason of the flush, compaction or write stall
+	Reason string
+	// Tables and bytes of the compaction inputs,
+	// of the flush, compaction or ingest outputs
+	InputTables  int
+	InputBytes   uint64
+	OutputTables int
+	OutputBytes  uint64
+	// Path and FileNum of the table, manifest or WAL file
+	Path    string
+	FileNum uint64
+	Err     error
+}
+
+// events is the ring of the recent pebble events
+type events struct {
+	*ring[Event]
+
+	mu sync.Mutex
+	// start of the write stall in progress
+	stallStart time.Time
+}
+
+func newEvents(history int) *events {
+	return &events{ring: newRing[Event](history)}
+}
+
+// Events returns the recent pebble events, oldest first,
+// notice: nil if not enabled with WithEventHistory
+func (s *PebbleKVStore) Events() []Event {
+	if s.events == nil {
+		return nil
+	}
+	return s.events.list()
+}
+
+// recordEvent adds the event to the history and logs it with the non-zero fields
+func (s *PebbleKVStore) recordEvent(e Event) {
+	e.Time = time.Now()
+	s.events.add(e)
+
+	level := hclog.Info
+	args := make([]interface{}, 0, 16)
+	if e.JobID != 0 {
+		args = append(args, "job", e.JobID)
+	}
+	if e.Reason != "" {
+		args = append(args, "reason", e.Reason)
+	}
+	if e.Duration != 0 {
+		args = append(args, "duration", e.Duration)
+	}
+	if e.InputTables != 0 {
+		args = append(args, "inputTables", e.InputTables, "inputBytes", e.InputBytes)
+	}
+	if e.OutputTables != 0 {
+		args = append(args, "outputTables", e.OutputTables, "outputBytes", e.OutputBytes)
+	}
+	if e.Path != "" {
+		args = append(args, "path", e.Path)
+	}
+	if e.FileNum != 0 {
+		args = append(args, "fileNum", e.FileNum)
+	}
+	switch {
+	case e.Err != nil:
+		level = hclog.Error
+		args = append(args, "error", e.Err)
+	case e.Type == EventWriteStallBegin:
+		level = hclog.Warn
+	}
+	s.logEvent(level, e.Type, args...)
+}
+
+func tablesSize(tables []pebble.TableInfo) (size uint64) {
+	for _, t := range tables {
+		size += t.Size
+	}
+	return
+}
+
+// recordFlush records the memtable flushes, the flush of the ingested tables
+// queued as a memtable is recorded by onTableIngested
+func (l *eventListener) recordFlush(info pebble.FlushInfo) {
+	if l.kv.events == nil || !info.Done || info.Ingest {
+		return
+	}
+	e := Event{
+		Type:         EventFlush,
+		JobID:        info.JobID,
+		Duration:     info.TotalDuration,
+		Reason:       info.Reason,
+		OutputTables: len(info.Output),
+		OutputBytes:  tablesSize(info.Output),
+		Err:          info.Err,
+	}
+	l.kv.recordEvent(e)
+}
+
+func (l *eventListener) recordCompaction(info pebble.CompactionInfo) {
+	if l.kv.events == nil || !info.Done {
+		return
+	}
+	e := Event{
+		Type:         EventCompaction,
+		JobID:        info.JobID,
+		Duration:     info.TotalDuration,
+		Reason:       info.Reason,
+		OutputTables: len(info.Output.Tables),
+		OutputBytes:  tablesSize(info.Output.Tables),
+		Err:          info.Err,
+	}
+	for _, level := range info.Input {
+		e.InputTables += len(level.Tables)
+		e.InputBytes += tablesSize(level.Tables)
+	}
+	l.kv.recordEvent(e)
+}
+
+func (l *eventListener) onTableIngested(info pebble.TableIngestInfo) {
+	if l.kv.events == nil {
+		return
+	}
+	e := Event{Type: EventIngest, JobID: info.JobID, Err: info.Err}
+	for _, t := range info.Tables {
+		e.OutputTables++
+		e.OutputBytes += t.Size
+	}
+	l.kv.recordEvent(e)
+}
+
+func (l *eventListener) onTableDeleted(info pebble.TableDeleteInfo) {
+	if l.kv.events == nil {
+		return
+	}
+	l.kv.recordEvent(Event{
+		Type:    EventTableDeleted,
+		JobID:   info.JobID,
+		Path:    info.Path,
+		FileNum: uint64(info.FileNum),
+		Err:     info.Err,
+	})
+}
+
+// onWriteStallBegin is called with the pebble DB mutex held, only records
+func (l *eventListener) onWriteStallBegin(info pebble.WriteStallBeginInfo) {
+	if l.kv.events == nil {
+		return
+	}
+	l.kv.events.mu.Lock()
+	l.kv.events.stallStart = time.Now()
+	l.kv.events.mu.Unlock()
+	l.kv.recordEvent(Event{Type: EventWriteStallBegin, Reason: info.Reason})
+}
+
+func (l *eventListener) onWriteStallEnd() {
+	if l.kv.events == nil {
+		return
+	}
+	e := Event{Type: EventWriteStallEnd}
+	l.kv.events.mu.Lock()
+	if !l.kv.events.stallStart.IsZero() {
+		e.Duration = time.Since(l.kv.events.stallStart)
+		l.kv.events.stallStart = time.Time{}
+	}
+	l.kv.events.mu.Unlock()
+	l.kv.recordEvent(e)
+}
+
+func (l *eventListener) onManifestCreated(info pebble.ManifestCreateInfo) {
+	if l.kv.events == nil {
+		return
+	}
+	l.kv.recordEvent(Event{
+		Type:    EventManifestCreated,
+		JobID:   info.JobID,
+		Path:    info.Path,
+		FileNum: uint64(info.FileNum),
+		Err:     info.Err,
+	})
+}
+
+func (l *eventListener) onManifestDeleted(info pebble.ManifestDeleteInfo) {
+	if l.kv.events == nil {
+		return
+	}
+	l.kv.recordEvent(Event{
+		Type:    EventManifestDeleted,
+		JobID:   info.JobID,
+		Path:    info.Path,
+		FileNum: uint64(info.FileNum),
+		Err:     info.Err,
+	})
+}
+
+func (l *eventListener) recordWALCreated(info pebble.WALCreateInfo) {
+	// the forced event of setEventListener has no path
+	if l.kv.events == nil || info.Path == "" {
+		return
+	}
+	l.kv.recordEvent(Event{
+		Type:    EventWALCreated,
+		JobID:   info.JobID,
+		Path:    info.Path,
+		FileNum: uint64(info.FileNum),
+		Err:     info.Err,
+	})
+}
+
+func (l *eventListener) onWALDeleted(info pebble.WALDeleteInfo) {
+	if l.kv.events == nil {
+		return
+	}
+	l.kv.recordEvent(Event{
+		Type:    EventWALDeleted,
+		JobID:   info.JobID,
+		Path:    info.Path,
+		FileNum: uint64(info.FileNum),
+		Err:     info.Err,
+	})
+}
+
+func (l *eventListener) onBackgroundError(err error) {
+	if l.kv.events == nil {
+		return
+	}
+	l.kv.recordEvent(Event{Type: EventBackgroundError, Err: err})
+}
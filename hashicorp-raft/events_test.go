@@ -0,0 +1,160 @@
+package raftpebble
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/objstorage/objstorageprovider"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func eventsOf(events []Event, typ string) []Event {
+	var of []Event
+	for _, e := range events {
+		if e.Type == typ {
+			of = append(of, e)
+		}
+	}
+	return of
+}
+
+func TestPebbleKVStore_Events(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithEventHistory(0))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// the manifest and WAL of the new db
+	events := store.Events()
+	assert.NotEmpty(t, eventsOf(events, EventManifestCreated))
+	assert.NotEmpty(t, eventsOf(events, EventWALCreated))
+
+	for round := uint64(0); round < 2; round++ {
+		for i := uint64(1); i <= 100; i++ {
+			assert.NoError(t, store.StoreLog(&raft.Log{Index: round*100 + i, Data: make([]byte, 128)}))
+		}
+		assert.NoError(t, store.db.Flush())
+	}
+	assert.NoError(t, store.db.Compact(prefixLog, prefixConf, false))
+
+	// the L0 tables may be compacted in background, and then deleted
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events = store.Events()
+		if len(eventsOf(events, EventCompaction)) > 0 && len(eventsOf(events, EventTableDeleted)) >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tables not compacted and deleted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	flushes := eventsOf(events, EventFlush)
+	if assert.Len(t, flushes, 2) {
+		assert.Equal(t, 1, flushes[0].OutputTables)
+		assert.True(t, flushes[0].OutputBytes > 100*128)
+		assert.True(t, flushes[0].Duration > 0)
+		assert.False(t, flushes[0].Time.IsZero())
+	}
+	compactions := eventsOf(events, EventCompaction)
+	if assert.NotEmpty(t, compactions) {
+		c := compactions[len(compactions)-1]
+		assert.Equal(t, 2, c.InputTables)
+		assert.True(t, c.InputBytes >= flushes[0].OutputBytes+flushes[1].OutputBytes)
+		assert.Equal(t, 1, c.OutputTables)
+		assert.True(t, c.OutputBytes > 0)
+	}
+	// the WAL rotated by the flushes
+	assert.True(t, len(eventsOf(events, EventWALCreated)) >= 3)
+	for i := 1; i < len(events); i++ {
+		assert.False(t, events[i].Time.Before(events[i-1].Time))
+	}
+}
+
+func TestPebbleKVStore_EventsIngest(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithEventHistory(0))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// the table overlaps the memtable, so it is ingested as a flushable,
+	// which is flushed with FlushInfo.Ingest
+	key := []byte("\xffingest")
+	assert.NoError(t, store.db.Set(key, []byte("memtable"), pebble.NoSync))
+	path := filepath.Join(dir, "ingest.sst")
+	f, err := vfs.Default.Create(path)
+	assert.NoError(t, err)
+	w := sstable.NewWriter(objstorageprovider.NewFileWritable(f), sstable.WriterOptions{
+		TableFormat: store.db.FormatMajorVersion().MaxTableFormat(),
+	})
+	assert.NoError(t, w.Set(key, []byte("ingested")))
+	assert.NoError(t, w.Close())
+	assert.NoError(t, store.db.Ingest([]string{path}))
+	assert.NoError(t, store.db.Flush())
+
+	ingests := eventsOf(store.Events(), EventIngest)
+	if assert.Len(t, ingests, 1) {
+		assert.Equal(t, 1, ingests[0].OutputTables)
+		assert.True(t, ingests[0].OutputBytes > 0)
+	}
+}
+
+func TestPebbleKVStore_EventsStallAndHistory(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithEventHistory(4))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	store.event.onWriteStallBegin(pebble.WriteStallBeginInfo{Reason: "memtable count limit reached"})
+	time.Sleep(10 * time.Millisecond)
+	store.event.onWriteStallEnd()
+	store.event.onBackgroundError(errors.New("disk error"))
+	store.event.onTableIngested(pebble.TableIngestInfo{JobID: 7})
+
+	events := store.Events()
+	assert.Len(t, events, 4)
+	begin, end := events[0], events[1]
+	assert.Equal(t, EventWriteStallBegin, begin.Type)
+	assert.Equal(t, "memtable count limit reached", begin.Reason)
+	assert.Equal(t, EventWriteStallEnd, end.Type)
+	assert.True(t, end.Duration >= 10*time.Millisecond)
+	assert.Equal(t, EventBackgroundError, events[2].Type)
+	assert.EqualError(t, events[2].Err, "disk error")
+	assert.Equal(t, EventIngest, events[3].Type)
+	assert.Equal(t, 7, events[3].JobID)
+
+	// bounded, the oldest are dropped
+	store.event.onWriteStallEnd()
+	events = store.Events()
+	assert.Len(t, events, 4)
+	assert.Equal(t, EventWriteStallEnd, events[0].Type)
+	assert.Equal(t, EventWriteStallEnd, events[3].Type)
+	// no stall in progress
+	assert.Zero(t, events[3].Duration)
+}
+
+func TestPebbleKVStore_EventsDisabled(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	assert.NoError(t, store.StoreLog(&raft.Log{Index: 1}))
+	assert.NoError(t, store.db.Flush())
+	assert.Nil(t, store.Events())
+}
@@ -0,0 +1,65 @@
+package raftpebble
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ErrStoreFailed is an error indicating pebble hit a fatal error through Logger.Fatalf,
+// eg: a synced WAL write EIO/ENOSPC, the commit pipeline of the db is broken after it,
+// so the store rejects writes, and the background workers stop touching the db.
+// notice: the reads may still work, but Close is the only valid operation, then reopen.
+// a WAL error found by a later commit, eg: an unsynced write with WithSync(false),
+// panics in pebble with the commit pipeline locked, which crashes the process.
+var ErrStoreFailed = errors.New("pebble store failed")
+
+// fatalError is the panic value of fatalLogger.Fatalf
+type fatalError struct {
+	msg string
+}
+
+// fatalLogger logs pebble fatal errors as info and panics with fatalError
+// instead of os.Exit, so the store can return the error to the caller.
+// notice: fatal in pebble background goroutines still crash the process
+type fatalLogger struct {
+	pebble.Logger
+}
+
+func (l fatalLogger) Fatalf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if el, ok := l.Logger.(errorLogger); ok {
+		el.Errorf("%s", msg)
+	} else {
+		l.Logger.Infof("%s", msg)
+	}
+	panic(fatalError{msg: msg})
+}
+
+// recoverFatal recovers the fatalError panic to err and fails the store,
+// use as defer s.recoverFatal(&err), other panics are re-panicked,
+// eg: the error panic of the pebble commit, which holds the commit pipeline lock
+// that db.Close waits on.
+func (s *PebbleKVStore) recoverFatal(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	fe, ok := r.(fatalError)
+	if !ok {
+		panic(r)
+	}
+
+	failed := fmt.Errorf("%w: %s", ErrStoreFailed, fe.msg)
+	s.failed.CompareAndSwap(nil, &failed)
+	*err = failed
+}
+
+// failure returns the fatal error if the store failed
+func (s *PebbleKVStore) failure() error {
+	if err := s.failed.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package raftpebble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// formatVersion is the on-disk format version written by the store:
+//
+//	0: legacy unversioned store, same layout as 1
+//	1: log key prefixLog + index, stable key prefixConf + key,
+//	   msgpack raft.Log values, metadata under prefixMeta
+//	2: LogStats range summaries under prefixMeta, maintained by the log writes,
+//	   so older versions can't write logs without them
+//	3: FSM applied index moved from prefixMeta to the reserved empty app key
+//
+// bump it with a migration when the key layout or value format changes.
+const formatVersion uint64 = 3
+
+// ErrUnknownFormatVersion is an error indicating the store format version
+// is newer than this code supports, or can't be migrated.
+var ErrUnknownFormatVersion = errors.New("unknown store format version")
+
+var formatVersionKey = encodeMetaKey(nil, []byte("format_version"))
+
+// MigrationProgress reports a format migration on open
+type MigrationProgress struct {
+	From uint64
+	To   uint64
+	Name string
+	// Keys migrated so far
+	Keys uint64
+	Done bool
+}
+
+// migration upgrades the format from version to from+1 in place,
+// the version is written after run, so run must be idempotent,
+// which reruns if the process crashes before.
+type migration struct {
+	from uint64
+	name string
+	run  func(s *PebbleKVStore, progress func(keys uint64)) error
+}
+
+// migrations are the format upgrades in order
+var migrations = []migration{
+	{
+		from: 0,
+		name: "write format version",
+		// layout unchanged, only marks the version
+		run: func(*PebbleKVStore, func(uint64)) error { return nil },
+	},
+	{
+		from: 1,
+		name: "persist log stats",
+		// the summaries are built on the next open with WithLogStats
+		run: func(*PebbleKVStore, func(uint64)) error { return nil },
+	},
+	{
+		from: 2,
+		name: "move applied index to app namespace",
+		run:  migrateAppliedIndex,
+	},
+}
+
+// FormatVersion returns the on-disk format version of the store
+func (s *PebbleKVStore) FormatVersion() uint64 {
+	return s.formatVersion
+}
+
+// openFormat checks the format version on open, a new store is created with target,
+// older ones are migrated to target, newer ones are refused.
+func (s *PebbleKVStore) openFormat(target uint64, migrations []migration) error {
+	version, found, err := s.readFormatVersion()
+	if err != nil {
+		return err
+	}
+	if !found {
+		if s.isEmptyDB() {
+			// new store
+			s.formatVersion = target
+			return s.writeFormatVersion(target)
+		}
+		version = 0
+	}
+	if version > target {
+		return fmt.Errorf("%w: %d, supports up to %d", ErrUnknownFormatVersion, version, target)
+	}
+
+	for version < target {
+		m := findMigration(migrations, version)
+		if m == nil {
+			return fmt.Errorf("%w: no migration from %d", ErrUnknownFormatVersion, version)
+		}
+		if err = s.runMigration(m); err != nil {
+			return fmt.Errorf("migrate format %d to %d: %w", version, version+1, err)
+		}
+		version++
+	}
+	s.formatVersion = version
+
+	return nil
+}
+
+func findMigration(migrations []migration, from uint64) *migration {
+	for i := range migrations {
+		if migrations[i].from == from {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
+
+func (s *PebbleKVStore) runMigration(m *migration) error {
+	p := MigrationProgress{From: m.from, To: m.from + 1, Name: m.name}
+	report := func() {
+		if s.options.migrationProgress != nil {
+			s.options.migrationProgress(p)
+		}
+	}
+
+	s.logger.Infof("raft-pebble: migrating format %d to %d: %s", p.From, p.To, p.Name)
+	report()
+	err := m.run(s, func(keys uint64) {
+		p.Keys = keys
+		report()
+	})
+	if err != nil {
+		return err
+	}
+	if err = s.writeFormatVersion(p.To); err != nil {
+		return err
+	}
+	p.Done = true
+	report()
+	s.logger.Infof("raft-pebble: migrated format %d to %d, %d keys", p.From, p.To, p.Keys)
+
+	return nil
+}
+
+func (s *PebbleKVStore) readFormatVersion() (version uint64, found bool, err error) {
+	err = s.GetValue(formatVersionKey, func(val []byte) error {
+		if val == nil {
+			return nil
+		}
+		if len(val) != 8 {
+			return fmt.Errorf("%w: malformed %x", ErrUnknownFormatVersion, val)
+		}
+		version, found = binary.BigEndian.Uint64(val), true
+		return nil
+	})
+
+	return
+}
+
+func (s *PebbleKVStore) writeFormatVersion(version uint64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], version)
+	return s.db.Set(formatVersionKey, b[:], pebble.Sync)
+}
+
+// isEmptyDB returns true if no key stored, a new store
+func (s *PebbleKVStore) isEmptyDB() bool {
+	iter := s.db.NewIter(nil)
+	defer iter.Close()
+
+	return !iter.First()
+}
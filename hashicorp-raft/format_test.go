@@ -0,0 +1,190 @@
+package raftpebble
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPebbleKVStore_FormatVersion_New(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	assert.Equal(t, formatVersion, store.FormatVersion())
+	version, found, err := store.readFormatVersion()
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, formatVersion, version)
+
+	// the meta key is neither a log nor a stable key
+	first, err := store.FirstIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), first)
+	assert.True(t, store.isEmptyLog())
+
+	store = reopenTestPebbleKVStore(t, store)
+	assert.Equal(t, formatVersion, store.FormatVersion())
+}
+
+func TestPebbleKVStore_FormatVersion_Legacy(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	assert.Nil(t, store.StoreLog(&raft.Log{Index: 1, Data: []byte("log1")}))
+	assert.Nil(t, store.SetUint64([]byte("CurrentTerm"), 2))
+	// an unversioned store written before format versioning
+	assert.Nil(t, store.db.Delete(formatVersionKey, pebble.Sync))
+
+	var progress []MigrationProgress
+	store = reopenTestPebbleKVStore(t, store, WithMigrationProgress(func(p MigrationProgress) {
+		progress = append(progress, p)
+	}))
+	assert.Equal(t, formatVersion, store.FormatVersion())
+	assert.NotEmpty(t, progress)
+	assert.Equal(t, uint64(0), progress[0].From)
+	assert.True(t, progress[len(progress)-1].Done)
+
+	log := new(raft.Log)
+	assert.Nil(t, store.GetLog(1, log))
+	assert.Equal(t, []byte("log1"), log.Data)
+	term, err := store.GetUint64([]byte("CurrentTerm"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), term)
+
+	// migrated once
+	progress = nil
+	store = reopenTestPebbleKVStore(t, store, WithMigrationProgress(func(p MigrationProgress) {
+		progress = append(progress, p)
+	}))
+	assert.Empty(t, progress)
+}
+
+func TestPebbleKVStore_FormatVersion_Unknown(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// written by a newer version
+	assert.Nil(t, store.writeFormatVersion(formatVersion+1))
+	assert.Nil(t, store.Close())
+
+	_, err := New(
+		WithFS(store.options.fs),
+		WithWalDirPath(store.options.walDir),
+		WithDbDirPath(store.options.dir),
+	)
+	assert.True(t, errors.Is(err, ErrUnknownFormatVersion), "err %v", err)
+}
+
+// testChecksumMigration is a sample 1 to 2 migration,
+// which appends a checksum byte to the stable values in batches.
+func testChecksumMigration(failAt uint64) migration {
+	return migration{
+		from: formatVersion,
+		name: "checksum stable values",
+		run: func(s *PebbleKVStore, progress func(uint64)) error {
+			iter := s.db.NewIter(&pebble.IterOptions{
+				LowerBound: prefixConf,
+				UpperBound: []byte{prefixMetaByte},
+			})
+			defer iter.Close()
+
+			var keys uint64
+			wb := s.db.NewBatch()
+			for iter.First(); iter.Valid(); iter.Next() {
+				val := iter.Value()
+				if len(val) == 9 && val[8] == checksum(val[:8]) {
+					// migrated before crash
+					continue
+				}
+				if keys == failAt {
+					wb.Close()
+					return fmt.Errorf("crash at %d", keys)
+				}
+				wb.Set(iter.Key(), append(append([]byte(nil), val...), checksum(val)), nil)
+				keys++
+				if keys%2 == 0 {
+					if err := s.db.Apply(wb, pebble.Sync); err != nil {
+						return err
+					}
+					wb = s.db.NewBatch()
+					progress(keys)
+				}
+			}
+			progress(keys)
+			return s.db.Apply(wb, pebble.Sync)
+		},
+	}
+}
+
+func checksum(b []byte) (c byte) {
+	for _, x := range b {
+		c ^= x
+	}
+	return
+}
+
+func TestPebbleKVStore_FormatMigration(t *testing.T) {
+	var progress []MigrationProgress
+	store, walDir, dir := testPebbleKVStore(t, WithMigrationProgress(func(p MigrationProgress) {
+		progress = append(progress, p)
+	}))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	for i := uint64(0); i < 5; i++ {
+		assert.Nil(t, store.SetUint64([]byte(fmt.Sprintf("key%d", i)), i))
+	}
+
+	// crash in the middle, the version is not bumped
+	all := append(append([]migration(nil), migrations...), testChecksumMigration(3))
+	err := store.openFormat(formatVersion+1, all)
+	assert.NotNil(t, err)
+	version, _, err := store.readFormatVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, formatVersion, version)
+
+	// rerun skips the migrated keys
+	progress = nil
+	all[len(all)-1] = testChecksumMigration(^uint64(0))
+	assert.Nil(t, store.openFormat(formatVersion+1, all))
+	assert.Equal(t, formatVersion+1, store.FormatVersion())
+	for i := uint64(0); i < 5; i++ {
+		val, err := store.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, 9, len(val))
+		assert.Equal(t, checksum(val[:8]), val[8])
+	}
+
+	assert.Equal(t, MigrationProgress{From: formatVersion, To: formatVersion + 1,
+		Name: "checksum stable values"}, progress[0])
+	for i := 1; i < len(progress); i++ {
+		assert.GreaterOrEqual(t, progress[i].Keys, progress[i-1].Keys)
+	}
+	last := progress[len(progress)-1]
+	assert.True(t, last.Done)
+	// 2 keys applied before crash
+	assert.Equal(t, uint64(3), last.Keys)
+
+	// no migration path
+	err = store.openFormat(formatVersion+2, all)
+	assert.True(t, errors.Is(err, ErrUnknownFormatVersion))
+}
@@ -0,0 +1,70 @@
+package raftpebble
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// HCLogger is a pebble.Logger on hclog.Logger, so the storage logs are
+// correlated with the raft logs, pebble info logs are at the info level,
+// and the store events are logged with the structured fields.
+type HCLogger struct {
+	logger hclog.Logger
+}
+
+// NewHCLogger returns a pebble.Logger logging to the "pebble" sub-logger of logger
+func NewHCLogger(logger hclog.Logger) *HCLogger {
+	return &HCLogger{logger: logger.Named("pebble")}
+}
+
+func (l *HCLogger) Infof(format string, args ...interface{}) {
+	if l.logger.IsInfo() {
+		l.logger.Info(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+	}
+}
+
+func (l *HCLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Error(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+// Fatalf logs at the error level and exits as pebble.DefaultLogger,
+// notice: the store recovers pebble fatal errors to ErrStoreFailed, see fatalLogger
+func (l *HCLogger) Fatalf(format string, args ...interface{}) {
+	l.Errorf(format, args...)
+	os.Exit(1)
+}
+
+// Log logs msg with the key/value fields
+func (l *HCLogger) Log(level hclog.Level, msg string, args ...interface{}) {
+	l.logger.Log(level, msg, args...)
+}
+
+// eventLogger is implemented by the loggers taking structured fields, eg: HCLogger
+type eventLogger interface {
+	Log(level hclog.Level, msg string, args ...interface{})
+}
+
+// errorLogger is implemented by the loggers with an error level, eg: HCLogger
+type errorLogger interface {
+	Errorf(format string, args ...interface{})
+}
+
+// logEvent logs the store event with the key/value fields, structured by
+// the eventLogger, as a "msg k=v ..." info log by the other pebble loggers.
+func (s *PebbleKVStore) logEvent(level hclog.Level, msg string, args ...interface{}) {
+	if s.eventLog != nil {
+		s.eventLog.Log(level, msg, args...)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("raft-pebble: ")
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	s.logger.Infof("%s", b.String())
+}
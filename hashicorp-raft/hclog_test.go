@@ -0,0 +1,148 @@
+package raftpebble
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer safe for the pebble background logs
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the json log lines
+func (b *syncBuffer) lines(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []map[string]interface{}
+	sc := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for sc.Scan() {
+		line := make(map[string]interface{})
+		assert.NoError(t, json.Unmarshal(sc.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestHCLogger(t *testing.T) {
+	out := &syncBuffer{}
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:       "raft",
+		Level:      hclog.Info,
+		Output:     out,
+		JSONFormat: true,
+	})
+	store, walDir, dir := testPebbleKVStore(t,
+		WithHCLogger(logger),
+		WithSlowOpThreshold(time.Nanosecond, 0))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	assert.NoError(t, store.StoreLogs([]*raft.Log{
+		{Index: 1, Data: []byte("data")},
+		{Index: 2, Data: []byte("data")},
+	}))
+	// the logger pebble is opened with
+	store.logger.Infof("[JOB %d] flushed", 1)
+
+	var pebbleInfo, slow map[string]interface{}
+	for _, line := range out.lines(t) {
+		assert.Equal(t, "raft.pebble", line["@module"])
+		if line["@message"] == "slow StoreLogs" {
+			slow = line
+		} else if line["@message"] == "[JOB 1] flushed" {
+			pebbleInfo = line
+		}
+	}
+	if assert.NotNil(t, pebbleInfo) {
+		assert.Equal(t, "info", pebbleInfo["@level"])
+	}
+	// the store events have the structured fields
+	if assert.NotNil(t, slow) {
+		assert.Equal(t, "warn", slow["@level"])
+		assert.Equal(t, float64(2), slow["entries"])
+		assert.Equal(t, float64(1), slow["firstIndex"])
+		assert.Equal(t, float64(2), slow["lastIndex"])
+		assert.Equal(t, float64(8), slow["bytes"])
+	}
+}
+
+func TestHCLogger_Levels(t *testing.T) {
+	out := &syncBuffer{}
+	l := NewHCLogger(hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.Warn,
+		Output:     out,
+		JSONFormat: true,
+	}))
+	l.Infof("info %d\n", 1)
+	l.Errorf("error %d\n", 2)
+	l.Log(hclog.Debug, "debug")
+	l.Log(hclog.Warn, "warn", "key", "val")
+
+	lines := out.lines(t)
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "error", lines[0]["@level"])
+	assert.Equal(t, "error 2", lines[0]["@message"])
+	assert.Equal(t, "pebble", lines[0]["@module"])
+	assert.Equal(t, "warn", lines[1]["@level"])
+	assert.Equal(t, "val", lines[1]["key"])
+}
+
+// captureLogger records the pebble info logs
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) Infof(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Fatalf(format string, args ...interface{}) {
+	panic(fmt.Sprintf(format, args...))
+}
+
+func TestPebbleKVStore_LogEventFields(t *testing.T) {
+	logger := &captureLogger{}
+	store, walDir, dir := testPebbleKVStore(t, WithLogger(logger))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// the pebble loggers get the fields formatted
+	store.logEvent(hclog.Warn, "event", "dir", "/wal", "bytes", 8)
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var found bool
+	for _, line := range logger.lines {
+		if strings.HasPrefix(line, "raft-pebble: event") {
+			assert.Equal(t, "raft-pebble: event dir=/wal bytes=8", line)
+			found = true
+		}
+	}
+	assert.True(t, found)
+}
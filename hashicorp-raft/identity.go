@@ -0,0 +1,123 @@
+package raftpebble
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ErrIdentityMismatch is an error indicating the store is bound to
+// another cluster or server than the expected identity.
+var ErrIdentityMismatch = errors.New("store identity mismatch")
+
+var (
+	storeIDKey = encodeMetaKey(nil, []byte("store_id"))
+
+	// stable keys, like raft CurrentTerm
+	clusterIDKey = []byte("ClusterID")
+	serverIDKey  = []byte("ServerID")
+)
+
+// Identity binds a store to a raft cluster server
+type Identity struct {
+	ClusterID string
+	ServerID  string
+}
+
+// StoreID returns the store UUID, which is created on first open
+func (s *PebbleKVStore) StoreID() string {
+	return s.storeID
+}
+
+// Identity returns the persisted identity, empty fields if not bound
+func (s *PebbleKVStore) Identity() (id Identity, err error) {
+	if id.ClusterID, err = s.getIdentity(clusterIDKey); err != nil {
+		return
+	}
+	id.ServerID, err = s.getIdentity(serverIDKey)
+	return
+}
+
+// openIdentity loads the store id, creates it on first open,
+// and checks the expected identity, the unbound fields are persisted.
+func (s *PebbleKVStore) openIdentity(expected *Identity) (err error) {
+	wb := s.db.NewBatch()
+	defer func() {
+		err = FirstError(err, wb.Close())
+	}()
+
+	err = s.GetValue(storeIDKey, func(val []byte) error {
+		s.storeID = string(val)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if s.storeID == "" {
+		if s.storeID, err = newUUID(); err != nil {
+			return
+		}
+		if err = wb.Set(storeIDKey, []byte(s.storeID), nil); err != nil {
+			return
+		}
+	}
+
+	if expected != nil {
+		for _, f := range []struct {
+			key      []byte
+			expected string
+		}{
+			{clusterIDKey, expected.ClusterID},
+			{serverIDKey, expected.ServerID},
+		} {
+			if err = s.bindIdentity(wb, f.key, f.expected); err != nil {
+				return
+			}
+		}
+	}
+
+	if wb.Empty() {
+		return
+	}
+	return s.db.Apply(wb, pebble.Sync)
+}
+
+// bindIdentity checks the persisted field of key is expected, or binds it
+func (s *PebbleKVStore) bindIdentity(wb *pebble.Batch, key []byte, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	persisted, err := s.getIdentity(key)
+	if err != nil {
+		return err
+	}
+	if persisted == "" {
+		return wb.Set(encodeStableKey(nil, key), []byte(expected), nil)
+	}
+	if persisted != expected {
+		return fmt.Errorf("%w: store %s %s is %q, expected %q",
+			ErrIdentityMismatch, s.storeID, key, persisted, expected)
+	}
+	return nil
+}
+
+func (s *PebbleKVStore) getIdentity(key []byte) (string, error) {
+	val, err := s.Get(key)
+	if err == ErrKeyNotFound {
+		return "", nil
+	}
+	return string(val), err
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,91 @@
+package raftpebble
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPebbleKVStore_StoreID(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	id := store.StoreID()
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+
+	// kept across reopen
+	store = reopenTestPebbleKVStore(t, store)
+	assert.Equal(t, id, store.StoreID())
+
+	// not bound without expected identity
+	bound, err := store.Identity()
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{}, bound)
+
+	other, walDir2, dir2 := testPebbleKVStore(t)
+	defer func() {
+		other.Close()
+		os.RemoveAll(walDir2)
+		os.RemoveAll(dir2)
+	}()
+	assert.NotEqual(t, id, other.StoreID())
+}
+
+func TestPebbleKVStore_ExpectedIdentity(t *testing.T) {
+	id := Identity{ClusterID: "cluster1", ServerID: "node1"}
+	store, walDir, dir := testPebbleKVStore(t, WithExpectedIdentity(id))
+	defer func() {
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	bound, err := store.Identity()
+	assert.Nil(t, err)
+	assert.Equal(t, id, bound)
+
+	// same identity and unchecked fields open
+	store = reopenTestPebbleKVStore(t, store, WithExpectedIdentity(id))
+	store = reopenTestPebbleKVStore(t, store, WithExpectedIdentity(Identity{ClusterID: "cluster1"}))
+	store = reopenTestPebbleKVStore(t, store)
+	assert.Nil(t, store.Close())
+
+	open := func(id Identity) error {
+		s, err := New(
+			WithFS(store.options.fs),
+			WithWalDirPath(store.options.walDir),
+			WithDbDirPath(store.options.dir),
+			WithExpectedIdentity(id),
+		)
+		if err == nil {
+			s.Close()
+		}
+		return err
+	}
+	err = open(Identity{ClusterID: "cluster1", ServerID: "node2"})
+	assert.True(t, errors.Is(err, ErrIdentityMismatch), "err %v", err)
+	err = open(Identity{ClusterID: "cluster2", ServerID: "node1"})
+	assert.True(t, errors.Is(err, ErrIdentityMismatch), "err %v", err)
+	assert.Nil(t, open(id))
+}
+
+func TestPebbleKVStore_ExpectedIdentity_Bind(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithExpectedIdentity(Identity{ClusterID: "cluster1"}))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// an unbound server id is bound on a later open
+	store = reopenTestPebbleKVStore(t, store, WithExpectedIdentity(Identity{ServerID: "node1"}))
+	bound, err := store.Identity()
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{ClusterID: "cluster1", ServerID: "node1"}, bound)
+}
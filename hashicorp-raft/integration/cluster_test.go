@@ -0,0 +1,400 @@
+package integration
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftpebble "github.com/weedge/raft-pebble"
+)
+
+// counterFSM sums the uint64 commands
+type counterFSM struct {
+	mu    sync.Mutex
+	Sum   uint64
+	Count uint64
+	Index uint64
+}
+
+func (f *counterFSM) Apply(l *raft.Log) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Sum += binary.BigEndian.Uint64(l.Data)
+	f.Count++
+	f.Index = l.Index
+	return f.Sum
+}
+
+func (f *counterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	buf, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return &counterSnapshot{buf: buf}, nil
+}
+
+func (f *counterFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return json.NewDecoder(rc).Decode(f)
+}
+
+func (f *counterFSM) state() (sum, count uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.Sum, f.Count
+}
+
+type counterSnapshot struct {
+	buf []byte
+}
+
+func (s *counterSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.buf); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *counterSnapshot) Release() {}
+
+// node is a raft server on PebbleKVStore, restartable from its dir
+type node struct {
+	id    raft.ServerID
+	addr  raft.ServerAddress
+	dir   string
+	store *raftpebble.PebbleKVStore
+	fsm   *counterFSM
+	trans *raft.InmemTransport
+	raft  *raft.Raft
+}
+
+type cluster struct {
+	t      *testing.T
+	config *raft.Config
+	nodes  []*node
+}
+
+func newCluster(t *testing.T, n int) *cluster {
+	c := &cluster{t: t}
+	c.config = raft.DefaultConfig()
+	c.config.HeartbeatTimeout = 50 * time.Millisecond
+	c.config.ElectionTimeout = 50 * time.Millisecond
+	c.config.LeaderLeaseTimeout = 50 * time.Millisecond
+	c.config.CommitTimeout = 5 * time.Millisecond
+	c.config.SnapshotInterval = time.Hour
+	c.config.SnapshotThreshold = 256
+	c.config.TrailingLogs = 128
+	c.config.Logger = hclog.New(&hclog.LoggerOptions{
+		Level:  hclog.Error,
+		Output: os.Stderr,
+	})
+
+	var servers []raft.Server
+	for i := 0; i < n; i++ {
+		nd := &node{
+			id:   raft.ServerID(fmt.Sprintf("node%d", i)),
+			addr: raft.ServerAddress(fmt.Sprintf("addr%d", i)),
+			dir:  t.TempDir(),
+		}
+		c.nodes = append(c.nodes, nd)
+		servers = append(servers, raft.Server{ID: nd.id, Address: nd.addr})
+	}
+	for i := range c.nodes {
+		c.start(i)
+	}
+	t.Cleanup(c.shutdown)
+
+	err := c.nodes[0].raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	if err != nil {
+		t.Fatalf("bootstrap err: %s", err)
+	}
+	return c
+}
+
+// start opens the node store from its dir and starts raft
+func (c *cluster) start(i int) {
+	nd := c.nodes[i]
+	store, err := raftpebble.New(
+		raftpebble.WithDbDirPath(filepath.Join(nd.dir, "raft")),
+		raftpebble.WithLogger(quietLogger{}),
+	)
+	if err != nil {
+		c.t.Fatalf("%s open store err: %s", nd.id, err)
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(nd.dir, 2, c.config.Logger)
+	if err != nil {
+		c.t.Fatalf("%s open snapshot store err: %s", nd.id, err)
+	}
+	_, trans := raft.NewInmemTransport(nd.addr)
+	for _, other := range c.nodes {
+		if other == nd || other.raft == nil {
+			continue
+		}
+		trans.Connect(other.addr, other.trans)
+		other.trans.Connect(nd.addr, trans)
+	}
+
+	conf := *c.config
+	conf.LocalID = nd.id
+	nd.store, nd.fsm, nd.trans = store, &counterFSM{}, trans
+	nd.raft, err = raft.NewRaft(&conf, nd.fsm, store, store, snaps, trans)
+	if err != nil {
+		c.t.Fatalf("%s new raft err: %s", nd.id, err)
+	}
+}
+
+// stop shuts down raft and closes the node store
+func (c *cluster) stop(i int) {
+	nd := c.nodes[i]
+	if nd.raft == nil {
+		return
+	}
+	if err := nd.raft.Shutdown().Error(); err != nil {
+		c.t.Fatalf("%s shutdown err: %s", nd.id, err)
+	}
+	for _, other := range c.nodes {
+		if other != nd && other.raft != nil {
+			other.trans.Disconnect(nd.addr)
+		}
+	}
+	nd.trans.Close()
+	if err := nd.store.Close(); err != nil {
+		c.t.Fatalf("%s close store err: %s", nd.id, err)
+	}
+	nd.raft = nil
+}
+
+func (c *cluster) restart(i int) {
+	c.stop(i)
+	c.start(i)
+}
+
+func (c *cluster) shutdown() {
+	for i := range c.nodes {
+		c.stop(i)
+	}
+}
+
+func (c *cluster) leader() *node {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, nd := range c.nodes {
+			if nd.raft != nil && nd.raft.State() == raft.Leader {
+				return nd
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("no leader elected")
+	return nil
+}
+
+// apply applies n commands of value 1..n through the leader,
+// retrying on not leader, which is never applied
+func (c *cluster) apply(n int) {
+	for i := 1; i <= n; i++ {
+		cmd := make([]byte, 8)
+		binary.BigEndian.PutUint64(cmd, uint64(i))
+		for retry := 0; ; retry++ {
+			err := c.leader().raft.Apply(cmd, 5*time.Second).Error()
+			if err == nil {
+				break
+			}
+			if retry > 10 || err != raft.ErrNotLeader {
+				c.t.Fatalf("apply %d err: %s", i, err)
+			}
+		}
+	}
+}
+
+func (c *cluster) snapshot(nd *node) {
+	if err := nd.raft.Snapshot().Error(); err != nil {
+		c.t.Fatalf("%s snapshot err: %s", nd.id, err)
+	}
+}
+
+// waitConverge waits all running nodes applied the same state, and returns it
+func (c *cluster) waitConverge() (sum, count uint64) {
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		leader := c.leader()
+		if err := leader.raft.Barrier(5 * time.Second).Error(); err != nil {
+			c.t.Fatalf("barrier err: %s", err)
+		}
+		sum, count = leader.fsm.state()
+		converged := true
+		for _, nd := range c.nodes {
+			if nd.raft == nil {
+				continue
+			}
+			if s, n := nd.fsm.state(); s != sum || n != count {
+				converged = false
+			}
+		}
+		if converged {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, nd := range c.nodes {
+				if nd.raft != nil {
+					s, n := nd.fsm.state()
+					c.t.Logf("%s sum %d count %d applied %d", nd.id, s, n, nd.raft.AppliedIndex())
+				}
+			}
+			c.t.Fatalf("fsm state not converged")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (c *cluster) checkTruncated(nd *node) {
+	first, err := nd.store.FirstIndex()
+	if err != nil {
+		c.t.Fatalf("%s first index err: %s", nd.id, err)
+	}
+	last, err := nd.store.LastIndex()
+	if err != nil {
+		c.t.Fatalf("%s last index err: %s", nd.id, err)
+	}
+	if first <= 1 || last-first+1 > c.config.TrailingLogs+c.config.SnapshotThreshold {
+		c.t.Fatalf("%s logs [%d,%d] not truncated", nd.id, first, last)
+	}
+}
+
+// quietLogger drops pebble info logs
+type quietLogger struct{}
+
+func (quietLogger) Infof(format string, args ...interface{}) {}
+func (quietLogger) Fatalf(format string, args ...interface{}) {
+	panic(fmt.Sprintf(format, args...))
+}
+
+func sumOf(n int) uint64 {
+	return uint64(n) * uint64(n+1) / 2
+}
+
+func TestCluster_ApplySnapshotRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip cluster test in short mode")
+	}
+	for _, n := range []int{3, 5} {
+		t.Run(fmt.Sprintf("nodes=%d", n), func(t *testing.T) {
+			c := newCluster(t, n)
+			c.leader()
+
+			c.apply(2000)
+			sum, count := c.waitConverge()
+			if sum != sumOf(2000) || count != 2000 {
+				t.Fatalf("bad state sum %d count %d", sum, count)
+			}
+
+			// force snapshots, which truncates the logs
+			for _, nd := range c.nodes {
+				c.snapshot(nd)
+				c.checkTruncated(nd)
+			}
+
+			// restart every node from disk, one by one
+			for i := range c.nodes {
+				c.restart(i)
+				c.apply(100)
+			}
+			sum, count = c.waitConverge()
+			if want := sumOf(2000) + uint64(n)*sumOf(100); sum != want || count != 2000+uint64(n)*100 {
+				t.Fatalf("bad state after restart sum %d want %d", sum, want)
+			}
+		})
+	}
+}
+
+func TestCluster_LeaderRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip cluster test in short mode")
+	}
+	c := newCluster(t, 3)
+
+	c.apply(500)
+	for i := 0; i < 3; i++ {
+		leader := c.leader()
+		for j, nd := range c.nodes {
+			if nd == leader {
+				// a new leader is elected while the old one restarts
+				c.restart(j)
+				break
+			}
+		}
+		c.apply(500)
+	}
+	sum, count := c.waitConverge()
+	if sum != 4*sumOf(500) || count != 2000 {
+		t.Fatalf("bad state sum %d count %d", sum, count)
+	}
+}
+
+func TestCluster_InstallSnapshot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip cluster test in short mode")
+	}
+	c := newCluster(t, 3)
+	c.apply(100)
+	c.waitConverge()
+
+	// a follower falls behind the truncated logs of the others
+	var lagging int
+	for i, nd := range c.nodes {
+		if nd != c.leader() {
+			lagging = i
+			break
+		}
+	}
+	c.stop(lagging)
+	c.apply(2000)
+	for _, nd := range c.nodes {
+		if nd.raft != nil {
+			c.snapshot(nd)
+			c.checkTruncated(nd)
+		}
+	}
+
+	// it catches up by installing the leader snapshot,
+	// which deletes all its logs as the store is monotonic
+	c.start(lagging)
+	sum, count := c.waitConverge()
+	if sum != sumOf(100)+sumOf(2000) || count != 2100 {
+		t.Fatalf("bad state sum %d count %d", sum, count)
+	}
+
+	c.apply(100)
+	c.waitConverge()
+	nd := c.nodes[lagging]
+	first, err := nd.store.FirstIndex()
+	if err != nil {
+		t.Fatalf("first index err: %s", err)
+	}
+	last, err := nd.store.LastIndex()
+	if err != nil {
+		t.Fatalf("last index err: %s", err)
+	}
+	for i := first; i <= last; i++ {
+		if err := nd.store.GetLog(i, new(raft.Log)); err != nil {
+			t.Fatalf("lagging node log [%d,%d] not contiguous at %d: %s", first, last, i, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package raftpebble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// key layout:
+//
+//	log:    prefixLog(1) + big endian index(8)
+//	stable: prefixConf(1) + raft stable key
+//	meta:   prefixMeta(1) + store metadata key
+//	app:    prefixApp(1) + application key, see AppStore,
+//	        the empty application key is the FSM applied index
+//
+// the encoders append the prefix byte, never to prefixLog/prefixConf,
+// so the package level prefix slices are never written through.
+const (
+	prefixLogByte  byte = 0x00
+	prefixConfByte byte = 0x01
+	prefixMetaByte byte = 0x02
+	prefixAppByte  byte = 0x03
+
+	// logKeyLen is the len of prefixLog + big endian index
+	logKeyLen = 1 + 8
+)
+
+// errMalformedKey is an error indicating a stored key is not the expected encoding
+var errMalformedKey = errors.New("malformed key")
+
+// logKey returns the log key of index in an array, which can live on stack
+func logKey(index uint64) (k [logKeyLen]byte) {
+	k[0] = prefixLogByte
+	binary.BigEndian.PutUint64(k[1:], index)
+	return
+}
+
+// encodeLogKey appends the log key of index to dst
+func encodeLogKey(dst []byte, index uint64) []byte {
+	k := logKey(index)
+	return append(dst, k[:]...)
+}
+
+// decodeLogKey returns the index of the log key,
+// the key must be exactly prefixLog + 8 bytes index.
+func decodeLogKey(key []byte) (uint64, error) {
+	if len(key) != logKeyLen || key[0] != prefixLogByte {
+		return 0, fmt.Errorf("%w: log key %x", errMalformedKey, key)
+	}
+	return binary.BigEndian.Uint64(key[1:]), nil
+}
+
+// encodeStableKey appends the stable key of key to dst,
+// key must not overlap the spare capacity of dst.
+func encodeStableKey(dst []byte, key []byte) []byte {
+	dst = append(dst, prefixConfByte)
+	return append(dst, key...)
+}
+
+// encodeMetaKey appends the store metadata key of key to dst,
+// key must not overlap the spare capacity of dst.
+func encodeMetaKey(dst []byte, key []byte) []byte {
+	dst = append(dst, prefixMetaByte)
+	return append(dst, key...)
+}
+
+// encodeAppKey appends the application key of key to dst,
+// key must not overlap the spare capacity of dst.
+func encodeAppKey(dst []byte, key []byte) []byte {
+	dst = append(dst, prefixAppByte)
+	return append(dst, key...)
+}
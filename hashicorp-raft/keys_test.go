@@ -0,0 +1,126 @@
+package raftpebble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogKey(t *testing.T) {
+	for _, index := range []uint64{0, 1, 255, 256, 1 << 32, ^uint64(0)} {
+		key := encodeLogKey(nil, index)
+		assert.Equal(t, logKeyLen, len(key))
+		assert.Equal(t, prefixLog, key[:1])
+
+		got, err := decodeLogKey(key)
+		assert.Nil(t, err)
+		assert.Equal(t, index, got)
+	}
+
+	// big endian keeps the index order
+	assert.Equal(t, -1, bytes.Compare(encodeLogKey(nil, 255), encodeLogKey(nil, 256)))
+
+	for _, key := range [][]byte{
+		nil,
+		{},
+		{prefixLogByte},
+		{prefixLogByte, 1, 2, 3, 4, 5, 6, 7},
+		{prefixLogByte, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{prefixConfByte, 1, 2, 3, 4, 5, 6, 7, 8},
+	} {
+		_, err := decodeLogKey(key)
+		assert.True(t, errors.Is(err, errMalformedKey), "key %x", key)
+	}
+}
+
+func TestKey_NoPrefixAliasing(t *testing.T) {
+	// dst sharing backing arrays must not write through the prefixes
+	buf := make([]byte, 0, 64)
+	a := encodeLogKey(buf, 1)
+	b := encodeStableKey(buf, []byte("CurrentTerm"))
+	c := encodeLogKey(buf[:0:0], 2)
+
+	assert.Equal(t, []byte{prefixLogByte}, prefixLog)
+	assert.Equal(t, []byte{prefixConfByte}, prefixConf)
+	assert.Equal(t, append([]byte{prefixConfByte}, "CurrentTerm"...), b)
+	// a shares buf with b, c doesn't
+	assert.NotEqual(t, encodeLogKey(nil, 1), a)
+	assert.Equal(t, encodeLogKey(nil, 2), c)
+}
+
+func TestPebbleKVStore_MalformedLogKey(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// a short key under prefixLog returns error instead of panic
+	err := store.db.Set([]byte{prefixLogByte, 1, 2}, []byte("bad"), pebble.Sync)
+	assert.Nil(t, err)
+
+	_, err = store.FirstIndex()
+	assert.True(t, errors.Is(err, errMalformedKey))
+	_, err = store.LastIndex()
+	assert.True(t, errors.Is(err, errMalformedKey))
+}
+
+func FuzzLogKey(f *testing.F) {
+	f.Add(uint64(0))
+	f.Add(uint64(1))
+	f.Add(^uint64(0))
+	f.Fuzz(func(t *testing.T, index uint64) {
+		key := logKey(index)
+		if !bytes.Equal(key[:], encodeLogKey(nil, index)) {
+			t.Fatalf("logKey %x != encodeLogKey", key)
+		}
+		got, err := decodeLogKey(key[:])
+		if err != nil || got != index {
+			t.Fatalf("decode %x: %d, %v", key, got, err)
+		}
+	})
+}
+
+func FuzzDecodeLogKey(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{prefixLogByte})
+	f.Add(encodeLogKey(nil, 1))
+	f.Add(encodeStableKey(nil, []byte("key")))
+	f.Fuzz(func(t *testing.T, key []byte) {
+		index, err := decodeLogKey(key)
+		valid := len(key) == logKeyLen && key[0] == prefixLogByte
+		if valid != (err == nil) {
+			t.Fatalf("decode %x valid %v err %v", key, valid, err)
+		}
+		if err == nil && index != binary.BigEndian.Uint64(key[1:]) {
+			t.Fatalf("decode %x: %d", key, index)
+		}
+	})
+}
+
+func FuzzEncodeStableKey(f *testing.F) {
+	f.Add([]byte(nil), []byte("CurrentTerm"))
+	f.Add([]byte{1, 2, 3}, []byte{})
+	f.Fuzz(func(t *testing.T, dst, key []byte) {
+		// fuzz args may share a backing array
+		key = append([]byte(nil), key...)
+		prefix := append([]byte(nil), dst...)
+		got := encodeStableKey(dst, key)
+		if len(got) != len(dst)+1+len(key) ||
+			!bytes.Equal(got[:len(dst)], prefix) ||
+			got[len(dst)] != prefixConfByte ||
+			!bytes.Equal(got[len(dst)+1:], key) {
+			t.Fatalf("encode %x %x: %x", dst, key, got)
+		}
+		// stable keys sort after all log keys
+		if bytes.Compare(got[len(dst):], encodeLogKey(nil, ^uint64(0))) <= 0 {
+			t.Fatalf("stable key %x sorts before log keys", got)
+		}
+	})
+}
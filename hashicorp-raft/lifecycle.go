@@ -0,0 +1,120 @@
+package raftpebble
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrClosed is an error indicating the store is closing or closed
+	ErrClosed = errors.New("pebble store closed")
+	// ErrCloseTimeout is an error indicating Close timed out waiting the in-flight calls,
+	// the store keeps rejecting calls, Close can be retried.
+	ErrCloseTimeout = errors.New("pebble store close timeout")
+)
+
+// defaultCloseTimeout is the max time Close waits the in-flight calls by default
+const defaultCloseTimeout = 10 * time.Second
+
+// closingBit is set in the refs once closing, so the new calls fail
+const closingBit = int64(1) << 62
+
+// lifecycle is the open -> closing -> closed state of the store,
+// the calls hold a ref while in flight, Close waits them to drain.
+type lifecycle struct {
+	// in-flight calls, with closingBit once closing
+	refs atomic.Int64
+	// signaled when the last ref is released while closing
+	drained chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	timeout time.Duration
+}
+
+func newLifecycle(timeout time.Duration) *lifecycle {
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+	return &lifecycle{
+		drained: make(chan struct{}, 1),
+		timeout: timeout,
+	}
+}
+
+// acquire takes a ref for a call, returns ErrClosed if closing or closed,
+// use as: if err = s.acquire(); err != nil {return}; defer s.release()
+func (s *PebbleKVStore) acquire() error {
+	if s.life.refs.Add(1)&closingBit != 0 {
+		s.release()
+		return ErrClosed
+	}
+	return nil
+}
+
+func (s *PebbleKVStore) release() {
+	if s.life.refs.Add(-1) == closingBit {
+		select {
+		case s.life.drained <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// beginClose rejects the new calls and waits the in-flight ones up to the timeout
+func (l *lifecycle) beginClose() error {
+	for {
+		n := l.refs.Load()
+		if n&closingBit != 0 || l.refs.CompareAndSwap(n, n|closingBit) {
+			break
+		}
+	}
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	for {
+		n := l.refs.Load() &^ closingBit
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-l.drained:
+		case <-timer.C:
+			return fmt.Errorf("%w: %d calls in flight after %v", ErrCloseTimeout, n, l.timeout)
+		}
+	}
+}
+
+// Close rejects the new calls with ErrClosed, waits the in-flight calls,
+// the open app iterators and snapshots up to the close timeout,
+// stops the background workers, flushes the memtables and closes the db,
+// so the reopen replays no WAL, the flush adds its latency to Close.
+// notice: on ErrCloseTimeout the store keeps rejecting calls, Close can be retried,
+// return ErrClosed if already closed
+func (s *PebbleKVStore) Close() (err error) {
+	s.life.mu.Lock()
+	defer s.life.mu.Unlock()
+
+	if s.life.closed {
+		return ErrClosed
+	}
+	if err = s.life.beginClose(); err != nil {
+		return
+	}
+	s.life.closed = true
+	defer s.recoverFatal(&err)
+
+	s.event.close()
+	// the final flush, skipped once failed
+	if s.failure() == nil {
+		err = s.db.Flush()
+	}
+	err = FirstError(err, s.db.Close())
+	if s.diskHealth != nil {
+		err = FirstError(err, s.diskHealth.Close())
+	}
+	return
+}
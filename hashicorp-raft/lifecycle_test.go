@@ -0,0 +1,146 @@
+package raftpebble
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPebbleKVStore_Closed(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	assert.NoError(t, store.StoreLog(&raft.Log{Index: 1, Data: []byte("data")}))
+	assert.NoError(t, store.Close())
+
+	var log raft.Log
+	assert.ErrorIs(t, store.GetLog(1, &log), ErrClosed)
+	assert.ErrorIs(t, store.StoreLog(&raft.Log{Index: 2}), ErrClosed)
+	assert.ErrorIs(t, store.StoreLogs([]*raft.Log{{Index: 2}}), ErrClosed)
+	assert.ErrorIs(t, store.DeleteRange(1, 1), ErrClosed)
+	assert.ErrorIs(t, store.GetLogView(1, func(LogView) error { return nil }), ErrClosed)
+	_, err := store.FirstIndex()
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = store.LastIndex()
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, store.Set([]byte("k"), []byte("v")), ErrClosed)
+	_, err = store.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = store.DiskUsage()
+	assert.ErrorIs(t, err, ErrClosed)
+
+	txn := store.NewTxn()
+	assert.ErrorIs(t, txn.StoreLog(&raft.Log{Index: 2}), ErrClosed)
+	txn.Discard()
+
+	app := store.App()
+	assert.ErrorIs(t, app.Set([]byte("k"), []byte("v")), ErrClosed)
+	assert.ErrorIs(t, app.Replay(func(*raft.Log) error { return nil }), ErrClosed)
+	iter := app.NewIter(nil, nil)
+	assert.False(t, iter.First())
+	assert.False(t, iter.Valid())
+	assert.ErrorIs(t, iter.Error(), ErrClosed)
+	assert.NoError(t, iter.Close())
+	snap := app.NewSnapshot()
+	_, err = snap.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, snap.NewIter(nil, nil).Error(), ErrClosed)
+	assert.NoError(t, snap.Close())
+
+	assert.ErrorIs(t, store.Close(), ErrClosed)
+}
+
+func TestPebbleKVStore_CloseInFlight(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := store.Set([]byte("k"), []byte("v")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var log raft.Log
+			for {
+				err := store.GetLog(1, &log)
+				if errors.Is(err, raft.ErrLogNotFound) {
+					continue
+				}
+				errs <- err
+				return
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, store.Close())
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.ErrorIs(t, err, ErrClosed)
+	}
+}
+
+func TestPebbleKVStore_CloseTimeout(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithCloseTimeout(20*time.Millisecond))
+	defer func() {
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	app := store.App()
+	assert.NoError(t, app.Set([]byte("k"), []byte("v")))
+
+	// the open iterator holds the store
+	iter := app.NewIter(nil, nil)
+	assert.True(t, iter.First())
+	assert.ErrorIs(t, store.Close(), ErrCloseTimeout)
+	// closing rejects the new calls, the open iterator still works
+	assert.ErrorIs(t, store.Set([]byte("k"), []byte("v")), ErrClosed)
+	assert.Equal(t, []byte("k"), iter.Key())
+	assert.Equal(t, []byte("v"), iter.Value())
+	assert.NoError(t, iter.Close())
+
+	assert.NoError(t, store.Close())
+	assert.ErrorIs(t, store.Close(), ErrClosed)
+}
+
+func TestPebbleKVStore_CloseFlush(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithEventHistory(0))
+	defer func() {
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+	for i := uint64(1); i <= 10; i++ {
+		assert.NoError(t, store.StoreLog(&raft.Log{Index: i, Data: []byte("data")}))
+	}
+	assert.Empty(t, eventsOf(store.Events(), EventFlush))
+	reopened := reopenTestPebbleKVStore(t, store)
+	defer reopened.Close()
+	// the memtable is flushed before closing
+	flushes := eventsOf(store.Events(), EventFlush)
+	if assert.Len(t, flushes, 1) {
+		assert.Equal(t, 1, flushes[0].OutputTables)
+	}
+
+	last, err := reopened.LastIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), last)
+}
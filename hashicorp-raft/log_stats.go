@@ -0,0 +1,357 @@
+package raftpebble
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// logs are summarized per index range of logStatsRangeSize,
+	// a partial truncated range is rebuilt by scanning at most this many logs
+	logStatsRangeSize uint64 = 1024
+)
+
+// LogStats is a summary of the retained raft logs,
+// AppendedAt zero time logs (eg: written by old raft version) are not counted in oldest/newest.
+// notice: if not monotonic, overwritten logs are counted again until truncated
+type LogStats struct {
+	FirstIndex       uint64
+	LastIndex        uint64
+	Entries          uint64
+	Bytes            uint64
+	OldestAppendedAt time.Time
+	NewestAppendedAt time.Time
+}
+
+// OldestAge returns how old is the oldest retained log,
+// if no AppendedAt recorded returns 0.
+func (s LogStats) OldestAge() time.Duration {
+	if s.OldestAppendedAt.IsZero() {
+		return 0
+	}
+	return time.Since(s.OldestAppendedAt)
+}
+
+// add merges a log with encoded size into the summary
+func (s *LogStats) add(log *raft.Log, size uint64) {
+	if s.Entries == 0 || log.Index < s.FirstIndex {
+		s.FirstIndex = log.Index
+	}
+	if s.Entries == 0 || log.Index > s.LastIndex {
+		s.LastIndex = log.Index
+	}
+	s.Entries++
+	s.Bytes += size
+	s.mergeAppendedAt(log.AppendedAt, log.AppendedAt)
+}
+
+// merge merges other summary into the summary
+func (s *LogStats) merge(o *LogStats) {
+	if o.Entries == 0 {
+		return
+	}
+	if s.Entries == 0 || o.FirstIndex < s.FirstIndex {
+		s.FirstIndex = o.FirstIndex
+	}
+	if s.Entries == 0 || o.LastIndex > s.LastIndex {
+		s.LastIndex = o.LastIndex
+	}
+	s.Entries += o.Entries
+	s.Bytes += o.Bytes
+	s.mergeAppendedAt(o.OldestAppendedAt, o.NewestAppendedAt)
+}
+
+func (s *LogStats) mergeAppendedAt(oldest, newest time.Time) {
+	if !oldest.IsZero() && (s.OldestAppendedAt.IsZero() || oldest.Before(s.OldestAppendedAt)) {
+		s.OldestAppendedAt = oldest
+	}
+	if !newest.IsZero() && newest.After(s.NewestAppendedAt) {
+		s.NewestAppendedAt = newest
+	}
+}
+
+// logStats maintains per index range summaries of the retained logs,
+// which are persisted under prefixMeta in the same batch as the log writes,
+// so the open loads them without scanning the log.
+type logStats struct {
+	// writeMu serializes the log writes, which stage the summaries before applying
+	writeMu sync.Mutex
+	// mu guards ranges, only held to install the applied summaries
+	mu     sync.Mutex
+	ranges map[uint64]*LogStats
+}
+
+func newLogStats() *logStats {
+	return &logStats{
+		ranges: make(map[uint64]*LogStats),
+	}
+}
+
+// logStatsUpdate is the range summaries changed by a log write,
+// a nil or empty summary is deleted, installed after the write applied.
+type logStatsUpdate map[uint64]*LogStats
+
+// rangeOf returns the staged summary of the range id, created if missing
+func (u logStatsUpdate) rangeOf(id uint64) *LogStats {
+	r := u[id]
+	if r == nil {
+		r = &LogStats{}
+		u[id] = r
+	}
+	return r
+}
+
+// write stages the summaries in the batch of the log write
+func (u logStatsUpdate) write(wb *pebble.Batch) error {
+	for id, r := range u {
+		key := logStatsKey(id)
+		if r == nil || r.Entries == 0 {
+			if err := wb.Delete(key, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := wb.Set(key, encodeLogStats(r), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stage adds a log with encoded size to a copy of its range summary,
+// notice: the caller holds writeMu
+func (ls *logStats) stage(u logStatsUpdate, log *raft.Log, size uint64) {
+	id := log.Index / logStatsRangeSize
+	if _, ok := u[id]; !ok {
+		if cur, ok := ls.ranges[id]; ok {
+			r := *cur
+			u[id] = &r
+		}
+	}
+	u.rangeOf(id).add(log, size)
+}
+
+// install replaces the summaries with the applied update
+func (ls *logStats) install(u logStatsUpdate) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for id, r := range u {
+		if r == nil || r.Entries == 0 {
+			delete(ls.ranges, id)
+		} else {
+			ls.ranges[id] = r
+		}
+	}
+}
+
+func (ls *logStats) summary() (s LogStats) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for _, r := range ls.ranges {
+		s.merge(r)
+	}
+	return
+}
+
+// logStatsPrefix is the meta key prefix of the range summaries
+var logStatsPrefix = encodeMetaKey(nil, []byte("log_stats/"))
+
+// logStatsKey returns the meta key of the range id summary
+func logStatsKey(id uint64) []byte {
+	k := make([]byte, len(logStatsPrefix)+8)
+	copy(k, logStatsPrefix)
+	binary.BigEndian.PutUint64(k[len(logStatsPrefix):], id)
+	return k
+}
+
+// logStatsUpperBound returns the exclusive upper bound of the range summaries
+func logStatsUpperBound() []byte {
+	k := append([]byte(nil), logStatsPrefix...)
+	k[len(k)-1]++
+	return k
+}
+
+// encodeLogStats encodes the summary as big endian first, last, entries, bytes,
+// oldest and newest AppendedAt unix nanos, 0 if zero time.
+func encodeLogStats(r *LogStats) []byte {
+	b := make([]byte, 48)
+	binary.BigEndian.PutUint64(b[0:], r.FirstIndex)
+	binary.BigEndian.PutUint64(b[8:], r.LastIndex)
+	binary.BigEndian.PutUint64(b[16:], r.Entries)
+	binary.BigEndian.PutUint64(b[24:], r.Bytes)
+	binary.BigEndian.PutUint64(b[32:], uint64(unixNano(r.OldestAppendedAt)))
+	binary.BigEndian.PutUint64(b[40:], uint64(unixNano(r.NewestAppendedAt)))
+	return b
+}
+
+func decodeLogStats(b []byte, r *LogStats) error {
+	if len(b) != 48 {
+		return fmt.Errorf("invalid log stats value, len %d", len(b))
+	}
+	r.FirstIndex = binary.BigEndian.Uint64(b[0:])
+	r.LastIndex = binary.BigEndian.Uint64(b[8:])
+	r.Entries = binary.BigEndian.Uint64(b[16:])
+	r.Bytes = binary.BigEndian.Uint64(b[24:])
+	r.OldestAppendedAt = fromUnixNano(int64(binary.BigEndian.Uint64(b[32:])))
+	r.NewestAppendedAt = fromUnixNano(int64(binary.BigEndian.Uint64(b[40:])))
+	return nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// openLogStats loads the persisted summaries, which are built by one scan
+// if missing, eg: the first open with WithLogStats
+func (s *PebbleKVStore) openLogStats() (err error) {
+	u := make(logStatsUpdate)
+	iter := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: logStatsPrefix,
+		UpperBound: logStatsUpperBound(),
+	})
+	for iter.First(); iter.Valid(); iter.Next() {
+		id := binary.BigEndian.Uint64(iter.Key()[len(logStatsPrefix):])
+		if err = decodeLogStats(iter.Value(), u.rangeOf(id)); err != nil {
+			break
+		}
+	}
+	if err = FirstError(err, iter.Close()); err != nil {
+		return
+	}
+
+	if len(u) == 0 && !s.isEmptyLog() {
+		if err = s.scanLogStats(s.db, 0, ^uint64(0), u); err != nil {
+			return
+		}
+		wb := s.db.NewBatch()
+		defer func() {
+			err = FirstError(err, wb.Close())
+		}()
+		if err = u.write(wb); err != nil {
+			return
+		}
+		if err = s.db.Apply(wb, pebble.Sync); err != nil {
+			return
+		}
+	}
+	s.stats.install(u)
+
+	return
+}
+
+// dropLogStats deletes the persisted summaries if opened without WithLogStats,
+// as the log writes don't maintain them, they are rebuilt on the next stats open.
+func (s *PebbleKVStore) dropLogStats() error {
+	upper := logStatsUpperBound()
+	iter := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: logStatsPrefix,
+		UpperBound: upper,
+	})
+	found := iter.First()
+	if err := iter.Close(); err != nil || !found {
+		return err
+	}
+	return s.db.DeleteRange(logStatsPrefix, upper, pebble.Sync)
+}
+
+// scanLogStats scans the logs in [min,max] of r to the summaries of u
+func (s *PebbleKVStore) scanLogStats(r pebble.Reader, min, max uint64, u logStatsUpdate) (err error) {
+	fk := logKey(min)
+	lk := prefixConf
+	if max != ^uint64(0) {
+		k := logKey(max + 1)
+		lk = k[:]
+	}
+	iter := r.NewIter(&pebble.IterOptions{
+		LowerBound: fk[:],
+		UpperBound: lk,
+	})
+	defer func() {
+		err = FirstError(err, iter.Close())
+	}()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		log := new(raft.Log)
+		if err = decodeMsgPack(iter.Value(), log); err != nil {
+			return
+		}
+		u.rangeOf(log.Index/logStatsRangeSize).add(log, uint64(len(iter.Key())+len(iter.Value())))
+	}
+
+	return
+}
+
+// rebuildLogStats stages the summaries of the ranges overlapping [min,max]
+// by scanning r, eg: an indexed batch with the staged deletes.
+// notice: the caller holds writeMu
+func (s *PebbleKVStore) rebuildLogStats(r pebble.Reader, min, max uint64, u logStatsUpdate) error {
+	minID, maxID := min/logStatsRangeSize, max/logStatsRangeSize
+	for id := range s.stats.ranges {
+		if id >= minID && id <= maxID {
+			u[id] = nil
+		}
+	}
+
+	// the last range end wraps to ^uint64(0)
+	return s.scanLogStats(r, minID*logStatsRangeSize, (maxID+1)*logStatsRangeSize-1, u)
+}
+
+// applyLogStats stages the summaries in the log write batch, applies it,
+// and installs the summaries.
+// notice: the caller holds writeMu
+func (s *PebbleKVStore) applyLogStats(wb *pebble.Batch, u logStatsUpdate) error {
+	if err := u.write(wb); err != nil {
+		return err
+	}
+	if err := s.db.Apply(wb, s.defaultWriteOpts); err != nil {
+		return err
+	}
+	s.stats.install(u)
+	return nil
+}
+
+// LogStats returns the summary of the retained logs without scanning the db,
+// notice: returns zero LogStats if not enabled with WithLogStats
+func (s *PebbleKVStore) LogStats() LogStats {
+	if s.stats == nil {
+		return LogStats{}
+	}
+	return s.stats.summary()
+}
+
+// runLogStatsMetrics emits LogStats gauges every interval until stop
+func (s *PebbleKVStore) runLogStatsMetrics(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			st := s.LogStats()
+			metrics.SetGauge([]string{"raft", "pebble", "logs", "entries"}, float32(st.Entries))
+			metrics.SetGauge([]string{"raft", "pebble", "logs", "bytes"}, float32(st.Bytes))
+			metrics.SetGauge([]string{"raft", "pebble", "logs", "oldestAgeMs"},
+				float32(st.OldestAge().Milliseconds()))
+		case <-s.event.stopper.ShouldStop():
+			return
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package raftpebble
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPebbleKVStore_LogStats(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithLogStats(0))
+	defer func() {
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// empty log has zero stats
+	assert.Equal(t, LogStats{}, store.LogStats())
+
+	now := time.Now()
+	var logs []*raft.Log
+	for i := 1; i <= 3000; i++ {
+		logs = append(logs, &raft.Log{
+			Index:      uint64(i),
+			Term:       1,
+			Data:       []byte("data"),
+			AppendedAt: now.Add(time.Duration(i) * time.Millisecond),
+		})
+	}
+	err := store.StoreLogs(logs)
+	assert.Nil(t, err)
+
+	st := store.LogStats()
+	assert.EqualValues(t, 1, st.FirstIndex)
+	assert.EqualValues(t, 3000, st.LastIndex)
+	assert.EqualValues(t, 3000, st.Entries)
+	assert.True(t, st.Bytes > 3000*uint64(len("data")))
+	assert.True(t, st.OldestAppendedAt.Equal(logs[0].AppendedAt))
+	assert.True(t, st.NewestAppendedAt.Equal(logs[2999].AppendedAt))
+	assert.True(t, st.OldestAge() > 0)
+
+	// prefix truncation in the middle of a range
+	err = store.DeleteRange(1, 1500)
+	assert.Nil(t, err)
+	st = store.LogStats()
+	assert.EqualValues(t, 1501, st.FirstIndex)
+	assert.EqualValues(t, 1500, st.Entries)
+	assert.True(t, st.OldestAppendedAt.Equal(logs[1500].AppendedAt))
+
+	// suffix truncation
+	err = store.DeleteRange(2001, 3000)
+	assert.Nil(t, err)
+	st = store.LogStats()
+	assert.EqualValues(t, 2000, st.LastIndex)
+	assert.EqualValues(t, 500, st.Entries)
+	assert.True(t, st.NewestAppendedAt.Equal(logs[1999].AppendedAt))
+
+	err = store.StoreLog(&raft.Log{Index: 2001, AppendedAt: now.Add(time.Hour)})
+	assert.Nil(t, err)
+	st = store.LogStats()
+	assert.EqualValues(t, 501, st.Entries)
+	bytes := st.Bytes
+
+	// rebuilt from db on reopen
+	store = reopenTestPebbleKVStore(t, store, WithLogStats(0))
+	defer store.Close()
+	st = store.LogStats()
+	assert.EqualValues(t, 1501, st.FirstIndex)
+	assert.EqualValues(t, 2001, st.LastIndex)
+	assert.EqualValues(t, 501, st.Entries)
+	assert.EqualValues(t, bytes, st.Bytes)
+	assert.True(t, st.OldestAppendedAt.Equal(logs[1500].AppendedAt))
+	assert.True(t, st.NewestAppendedAt.Equal(now.Add(time.Hour)))
+
+	// delete all
+	err = store.DeleteRange(0, 2001)
+	assert.Nil(t, err)
+	assert.Equal(t, LogStats{}, store.LogStats())
+}
+
+func TestPebbleKVStore_LogStats_Disabled(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	err := store.StoreLogs([]*raft.Log{{Index: 1, AppendedAt: time.Now()}})
+	assert.Nil(t, err)
+	assert.Equal(t, LogStats{}, store.LogStats())
+}
+
+func TestPebbleKVStore_LogStats_Metrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	cfg := metrics.DefaultConfig("")
+	cfg.EnableHostname = false
+	cfg.EnableRuntimeMetrics = false
+	if _, err := metrics.NewGlobal(cfg, sink); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	store, walDir, dir := testPebbleKVStore(t, WithLogStats(10*time.Millisecond))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	err := store.StoreLogs([]*raft.Log{{Index: 1}, {Index: 2}})
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		for _, interval := range sink.Data() {
+			interval.RLock()
+			g, ok := interval.Gauges["raft.pebble.logs.entries"]
+			interval.RUnlock()
+			if ok && g.Value == 2 {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
+
+// countLogStatsKeys returns the number of persisted range summaries
+func countLogStatsKeys(t *testing.T, store *PebbleKVStore) (n int) {
+	iter := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: logStatsPrefix,
+		UpperBound: logStatsUpperBound(),
+	})
+	for iter.First(); iter.Valid(); iter.Next() {
+		n++
+	}
+	assert.Nil(t, iter.Close())
+	return
+}
+
+func TestPebbleKVStore_LogStats_Persisted(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithLogStats(0))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	var logs []*raft.Log
+	for i := 1; i <= 2500; i++ {
+		logs = append(logs, &raft.Log{Index: uint64(i), Data: []byte("data"), AppendedAt: time.Now()})
+	}
+	assert.Nil(t, store.StoreLogs(logs))
+	assert.Nil(t, store.DeleteRange(1, 1100))
+	assert.Equal(t, 2, countLogStatsKeys(t, store))
+	st := store.LogStats()
+
+	// loaded without scanning the logs, a log deleted behind the summaries isn't seen
+	k := logKey(2500)
+	assert.Nil(t, store.db.Delete(k[:], pebble.Sync))
+	store = reopenTestPebbleKVStore(t, store, WithLogStats(0))
+	assert.Equal(t, st.Entries, store.LogStats().Entries)
+	assert.True(t, st.OldestAppendedAt.Equal(store.LogStats().OldestAppendedAt))
+
+	// dropped without stats, as the writes don't maintain them
+	store = reopenTestPebbleKVStore(t, store)
+	assert.Equal(t, 0, countLogStatsKeys(t, store))
+	assert.Nil(t, store.StoreLog(&raft.Log{Index: 2500}))
+
+	// rebuilt by a scan on the next stats open
+	store = reopenTestPebbleKVStore(t, store, WithLogStats(0))
+	assert.Equal(t, 2, countLogStatsKeys(t, store))
+	st = store.LogStats()
+	assert.EqualValues(t, 1101, st.FirstIndex)
+	assert.EqualValues(t, 2500, st.LastIndex)
+	assert.EqualValues(t, 1400, st.Entries)
+}
+
+func TestPebbleKVStore_LogStats_Txn(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithLogStats(0))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	txn := store.NewTxn()
+	for i := uint64(1); i <= 2000; i++ {
+		assert.Nil(t, txn.StoreLog(&raft.Log{Index: i, Data: []byte("data")}))
+	}
+	assert.Nil(t, txn.DeleteRange(1, 500))
+	assert.Nil(t, txn.Commit())
+	st := store.LogStats()
+	assert.EqualValues(t, 501, st.FirstIndex)
+	assert.EqualValues(t, 1500, st.Entries)
+
+	txn = store.NewTxn()
+	assert.Nil(t, txn.StoreLog(&raft.Log{Index: 2001, Data: []byte("data")}))
+	assert.Nil(t, txn.Commit())
+	st = store.LogStats()
+	assert.EqualValues(t, 1501, st.Entries)
+
+	// the summaries are committed with the logs
+	store = reopenTestPebbleKVStore(t, store, WithLogStats(0))
+	assert.Equal(t, st, store.LogStats())
+}
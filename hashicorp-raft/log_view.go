@@ -0,0 +1,301 @@
+package raftpebble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+)
+
+// errMalformedLog is an error indicating a stored log is not the msgpack raft.Log encoding
+var errMalformedLog = errors.New("malformed msgpack log")
+
+// LogView is a zero-copy view of a stored raft log,
+// Data and Extensions reference pebble owned memory,
+// which are only valid inside the GetLogView callback, copy them to retain.
+type LogView struct {
+	Index      uint64
+	Term       uint64
+	Type       raft.LogType
+	Data       []byte
+	Extensions []byte
+	AppendedAt time.Time
+}
+
+// CopyTo copies the view to log, which is safe to use after the callback
+func (v *LogView) CopyTo(log *raft.Log) {
+	log.Index = v.Index
+	log.Term = v.Term
+	log.Type = v.Type
+	log.Data = copyBytes(v.Data)
+	log.Extensions = copyBytes(v.Extensions)
+	log.AppendedAt = v.AppendedAt
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// GetLogView calls fn with a zero-copy view of the log at index,
+// without msgpack reflection decode and Data copy as GetLog.
+// notice: if index log not found return raft ErrLogNotFound,
+// the view slices must not be used or retained after fn returns.
+func (s *PebbleKVStore) GetLogView(index uint64, fn func(LogView) error) (err error) {
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
+	kb := getKeyBuf()
+	key := encodeLogKey(kb.b[:0], index)
+	defer putKeyBuf(kb, key)
+	val, closer, err := s.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = FirstError(err, closer.Close())
+	}()
+
+	var view LogView
+	if err = decodeLogView(val, &view); err != nil {
+		return
+	}
+
+	return fn(view)
+}
+
+// decodeLogView decodes the msgpack raft.Log map encoded by encodeMsgPack,
+// unknown fields are skipped.
+func decodeLogView(buf []byte, v *LogView) error {
+	d := &msgpackReader{buf: buf}
+	n, err := d.mapLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		name, err := d.raw()
+		if err != nil {
+			return err
+		}
+		switch string(name) {
+		case "Index":
+			v.Index, err = d.uint()
+		case "Term":
+			v.Term, err = d.uint()
+		case "Type":
+			var t uint64
+			t, err = d.uint()
+			v.Type = raft.LogType(t)
+		case "Data":
+			v.Data, err = d.raw()
+		case "Extensions":
+			v.Extensions, err = d.raw()
+		case "AppendedAt":
+			var b []byte
+			if b, err = d.raw(); err == nil && b != nil {
+				err = v.AppendedAt.UnmarshalBinary(b)
+			}
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return fmt.Errorf("%w: field %s: %v", errMalformedLog, name, err)
+		}
+	}
+
+	return nil
+}
+
+// msgpackReader reads the msgpack subset written by go-msgpack codec MsgpackHandle
+type msgpackReader struct {
+	buf []byte
+	off int
+}
+
+func (d *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(d.buf)-d.off < n {
+		return nil, errMalformedLog
+	}
+	b := d.buf[d.off : d.off+n : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *msgpackReader) byte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// size reads a big endian uint of n bytes
+func (d *msgpackReader) size(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (d *msgpackReader) mapLen() (int, error) {
+	c, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c >= 0x80 && c <= 0x8f:
+		return int(c & 0x0f), nil
+	case c == 0xde:
+		n, err := d.size(2)
+		return int(n), err
+	case c == 0xdf:
+		n, err := d.size(4)
+		return int(n), err
+	}
+	return 0, errMalformedLog
+}
+
+func (d *msgpackReader) uint() (uint64, error) {
+	c, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c <= 0x7f:
+		return uint64(c), nil
+	case c >= 0xcc && c <= 0xcf:
+		return d.size(1 << (c - 0xcc))
+	case c >= 0xd0 && c <= 0xd3:
+		// signed encoding of a non-negative value
+		n, err := d.size(1 << (c - 0xd0))
+		if err == nil && n>>(8<<(c-0xd0)-1) != 0 {
+			err = errMalformedLog
+		}
+		return n, err
+	}
+	return 0, errMalformedLog
+}
+
+// raw reads raw/str/bin bytes, nil for msgpack nil or empty
+func (d *msgpackReader) raw() ([]byte, error) {
+	c, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	var n uint64
+	switch {
+	case c == 0xc0:
+		return nil, nil
+	case c >= 0xa0 && c <= 0xbf:
+		n = uint64(c & 0x1f)
+	case c == 0xd9 || c == 0xc4:
+		n, err = d.size(1)
+	case c == 0xda || c == 0xc5:
+		n, err = d.size(2)
+	case c == 0xdb || c == 0xc6:
+		n, err = d.size(4)
+	default:
+		return nil, errMalformedLog
+	}
+	if err != nil || n == 0 {
+		// empty as nil like codec decode
+		return nil, err
+	}
+	return d.next(int(n))
+}
+
+// skip skips a value of any type
+func (d *msgpackReader) skip() error {
+	c, err := d.byte()
+	if err != nil {
+		return err
+	}
+	var n uint64
+	switch {
+	case c <= 0x7f, c >= 0xe0, c == 0xc0, c == 0xc2, c == 0xc3:
+		return nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.skipN(2 * int(c&0x0f))
+	case c >= 0x90 && c <= 0x9f:
+		return d.skipN(int(c & 0x0f))
+	case c >= 0xa0 && c <= 0xbf:
+		_, err = d.next(int(c & 0x1f))
+		return err
+	case c == 0xca:
+		_, err = d.next(4)
+		return err
+	case c == 0xcb:
+		_, err = d.next(8)
+		return err
+	case c >= 0xcc && c <= 0xcf:
+		_, err = d.next(1 << (c - 0xcc))
+		return err
+	case c >= 0xd0 && c <= 0xd3:
+		_, err = d.next(1 << (c - 0xd0))
+		return err
+	case c >= 0xd4 && c <= 0xd8:
+		// fixext: type + 1<<k data
+		_, err = d.next(1 + 1<<(c-0xd4))
+		return err
+	case c == 0xd9 || c == 0xc4:
+		n, err = d.size(1)
+	case c == 0xda || c == 0xc5:
+		n, err = d.size(2)
+	case c == 0xdb || c == 0xc6:
+		n, err = d.size(4)
+	case c >= 0xc7 && c <= 0xc9:
+		// ext: len + type + data
+		if n, err = d.size(1 << (c - 0xc7)); err == nil {
+			n++
+		}
+	case c == 0xdc || c == 0xdd:
+		if n, err = d.size(2 << (c - 0xdc)); err == nil {
+			err = d.skipN(int(n))
+		}
+		return err
+	case c == 0xde || c == 0xdf:
+		if n, err = d.size(2 << (c - 0xde)); err == nil {
+			err = d.skipN(2 * int(n))
+		}
+		return err
+	default:
+		return errMalformedLog
+	}
+	if err != nil {
+		return err
+	}
+	_, err = d.next(int(n))
+	return err
+}
+
+func (d *msgpackReader) skipN(n int) error {
+	for i := 0; i < n; i++ {
+		if err := d.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package raftpebble
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPebbleKVStore_GetLogView(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	err := store.GetLogView(1, func(LogView) error {
+		t.Fatalf("callback on not found log")
+		return nil
+	})
+	assert.ErrorIs(t, err, raft.ErrLogNotFound)
+
+	big := make([]byte, 70000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogCommand, Data: []byte("log1"), AppendedAt: time.Now()},
+		{Index: 2, Term: 300, Type: raft.LogConfiguration, Extensions: []byte("ext")},
+		{Index: 3, Term: 70000, Type: raft.LogBarrier, Data: make([]byte, 200)},
+		{Index: 4, Term: 1 << 40, Data: big, Extensions: big[:300]},
+		{Index: 5, Term: 1 << 40, Data: []byte{}},
+	}
+	err = store.StoreLogs(logs)
+	assert.Nil(t, err)
+
+	for _, want := range logs {
+		expected := new(raft.Log)
+		err = store.GetLog(want.Index, expected)
+		assert.Nil(t, err)
+
+		got := new(raft.Log)
+		err = store.GetLogView(want.Index, func(view LogView) error {
+			assert.Equal(t, expected.Index, view.Index)
+			assert.Equal(t, expected.Term, view.Term)
+			assert.Equal(t, expected.Type, view.Type)
+			assert.Equal(t, len(expected.Data), len(view.Data))
+			assert.Equal(t, len(expected.Extensions), len(view.Extensions))
+			view.CopyTo(got)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, expected.Data, got.Data)
+		assert.Equal(t, expected.Extensions, got.Extensions)
+		assert.True(t, expected.AppendedAt.Equal(got.AppendedAt))
+	}
+
+	// callback error is returned
+	cbErr := errors.New("callback")
+	err = store.GetLogView(1, func(LogView) error {
+		return cbErr
+	})
+	assert.ErrorIs(t, err, cbErr)
+}
+
+func TestDecodeLogView(t *testing.T) {
+	// fields from other raft versions are skipped
+	type oldLog struct {
+		Index   uint64
+		Term    uint64
+		Type    raft.LogType
+		Data    []byte
+		Unknown map[string][]int64
+		Float   float64
+		Neg     int32
+		Flag    bool
+	}
+	buf, err := encodeMsgPack(&oldLog{
+		Index:   7,
+		Term:    3,
+		Data:    []byte("data"),
+		Unknown: map[string][]int64{"a": {1, -200, 1 << 33}},
+		Float:   1.5,
+		Neg:     -70000,
+		Flag:    true,
+	})
+	assert.Nil(t, err)
+
+	var view LogView
+	err = decodeLogView(buf.Bytes(), &view)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 7, view.Index)
+	assert.EqualValues(t, 3, view.Term)
+	assert.Equal(t, []byte("data"), view.Data)
+	assert.True(t, view.AppendedAt.IsZero())
+
+	// truncated and not a map
+	full, err := encodeMsgPack(&raft.Log{Index: 1, Data: []byte("data")})
+	assert.Nil(t, err)
+	for i := 0; i < full.Len(); i++ {
+		err = decodeLogView(full.Bytes()[:i], &view)
+		assert.ErrorIs(t, err, errMalformedLog, i)
+	}
+	var arr []byte
+	err = codec.NewEncoderBytes(&arr, &codec.MsgpackHandle{}).Encode([]int{1})
+	assert.Nil(t, err)
+	err = decodeLogView(arr, &view)
+	assert.ErrorIs(t, err, errMalformedLog)
+}
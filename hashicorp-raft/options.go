@@ -1,8 +1,12 @@
 package raftpebble
 
 import (
+	"time"
+
 	"github.com/cockroachdb/pebble"
 	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type options struct {
@@ -12,6 +16,41 @@ type options struct {
 	walDir   string
 	dir      string
 	callback LogDBCallback
+	// sync WAL on each write, default false
+	sync bool
+	// enforce raft.MonotonicLogStore contract, default true
+	monotonic bool
+	// maintain LogStats, emit metrics every logStatsInterval if > 0
+	logStats         bool
+	logStatsInterval time.Duration
+	// called with the format migration progress on open
+	migrationProgress func(MigrationProgress)
+	// compact truncated logs past compactMinEntries, at most every compactMinInterval
+	compactMinEntries  uint64
+	compactMinInterval time.Duration
+	// reject log writes past diskQuota bytes if > 0
+	diskQuota       uint64
+	onQuotaExceeded func(DiskUsage)
+	// reject writes below minFreeDisk bytes, checked every diskCheckInterval
+	minFreeDisk       uint64
+	diskCheckInterval time.Duration
+	onDiskSpaceChange func(DiskSpaceState)
+	// create the WAL files in walSecondaryDir while the primary WAL is slow
+	walSecondaryDir     string
+	walLatencyThreshold time.Duration
+	onWALFailover       func(WALFailoverInfo)
+	// record the calls and disk operations slower than slowOpThreshold if > 0,
+	// the recent slowOpHistory ones are kept
+	slowOpThreshold time.Duration
+	slowOpHistory   int
+	// record the pebble events, keep the recent eventHistory ones if > 0
+	eventHistory int
+	// span the store ops if not nil
+	tracerProvider trace.TracerProvider
+	// fail open if the store is bound to another identity
+	expectedIdentity *Identity
+	// max time Close waits the in-flight calls
+	closeTimeout time.Duration
 
 	// optional, more details see pebble Options
 	// if use pebble options, config options can't use
@@ -48,6 +87,14 @@ func WithLogger(logger pebble.Logger) Option {
 	})
 }
 
+// WithHCLogger logs the pebble and store logs to the "pebble" sub-logger of
+// logger, the store events with the structured fields, see HCLogger.
+func WithHCLogger(logger hclog.Logger) Option {
+	return newOption(func(o *options) {
+		o.logger = NewHCLogger(logger)
+	})
+}
+
 func WithFS(fs vfs.FS) Option {
 	return newOption(func(o *options) {
 		o.fs = fs
@@ -72,6 +119,153 @@ func WithLogDBCallback(cb LogDBCallback) Option {
 	})
 }
 
+// WithSync enables fsync WAL on each write,
+// if disabled, writes are fast but may be lost on machine crash,
+// and a WAL write error is not returned by the write, but crashes a later one,
+// see ErrStoreFailed.
+func WithSync(sync bool) Option {
+	return newOption(func(o *options) {
+		o.sync = sync
+	})
+}
+
+// WithMonotonic enables or disables the raft.MonotonicLogStore contract,
+// if disabled, logs may have gaps and DeleteRange may delete from the middle.
+func WithMonotonic(monotonic bool) Option {
+	return newOption(func(o *options) {
+		o.monotonic = monotonic
+	})
+}
+
+// WithLogStats enables LogStats summaries of the retained logs,
+// which are persisted with the log writes and loaded on open,
+// the logs are scanned once if opened without stats before,
+// and emits go-metrics gauges every metricsInterval, 0 to disable metrics.
+func WithLogStats(metricsInterval time.Duration) Option {
+	return newOption(func(o *options) {
+		o.logStats = true
+		o.logStatsInterval = metricsInterval
+	})
+}
+
+// WithDeleteRangeCompaction compacts the deleted logs span in background,
+// once minEntries logs are deleted, at most one compaction every minInterval,
+// which reclaims the disk space without waiting for pebble to compact the span.
+func WithDeleteRangeCompaction(minEntries uint64, minInterval time.Duration) Option {
+	return newOption(func(o *options) {
+		if minEntries == 0 {
+			minEntries = 1
+		}
+		o.compactMinEntries = minEntries
+		o.compactMinInterval = minInterval
+	})
+}
+
+// WithDiskQuota rejects the log writes with ErrQuotaExceeded before the store
+// uses more than maxBytes disk, and calls onExceeded in background once
+// until the usage is under the quota again, so the application can snapshot
+// and truncate the logs, onExceeded can be nil.
+// notice: the stable store and DeleteRange writes are never rejected
+func WithDiskQuota(maxBytes uint64, onExceeded func(DiskUsage)) Option {
+	return newOption(func(o *options) {
+		o.diskQuota = maxBytes
+		o.onQuotaExceeded = onExceeded
+	})
+}
+
+// WithLowDiskWatchdog checks the free space of the db and WAL dirs every interval
+// with the configured vfs.FS, below minFreeBytes the store rejects the log and
+// app writes with ErrLowDiskSpace before pebble fails on a full disk,
+// and accepts them again above minFreeBytes plus 10%,
+// onChange is called with the state changes, which can be nil.
+// notice: the stable store and DeleteRange writes are never rejected
+func WithLowDiskWatchdog(minFreeBytes uint64, interval time.Duration, onChange func(DiskSpaceState)) Option {
+	return newOption(func(o *options) {
+		o.minFreeDisk = minFreeBytes
+		o.diskCheckInterval = interval
+		o.onDiskSpaceChange = onChange
+	})
+}
+
+// WithWALFailover creates the WAL files in secondaryDir once a primary WAL
+// write or sync takes longer than latencyThreshold, eg: a degraded SSD,
+// and back in the primary WAL dir once it is healthy again,
+// onChange is called with the switches, which can be nil,
+// latencyThreshold defaults to defaultWALLatencyThreshold if <= 0.
+// a write, sync or preallocate stalled on the primary past latencyThreshold is
+// moved with the WAL file to the secondary, so the commits go on during the stall.
+// notice: the move re-reads the written bytes from the primary WAL file, keep
+// secondaryDir configured, as pebble recovers the WAL files of both dirs on open.
+func WithWALFailover(secondaryDir string, latencyThreshold time.Duration, onChange func(WALFailoverInfo)) Option {
+	return newOption(func(o *options) {
+		if latencyThreshold <= 0 {
+			latencyThreshold = defaultWALLatencyThreshold
+		}
+		o.walSecondaryDir = secondaryDir
+		o.walLatencyThreshold = latencyThreshold
+		o.onWALFailover = onChange
+	})
+}
+
+// WithSlowOpThreshold measures StoreLog(s) and Set, the calls slower than
+// threshold are logged with the batch size, and the recent history ones
+// are kept for SlowOps, history defaults to defaultSlowOpHistory if <= 0,
+// the pebble disk operations slower than threshold are recorded as DiskSlow.
+func WithSlowOpThreshold(threshold time.Duration, history int) Option {
+	return newOption(func(o *options) {
+		o.slowOpThreshold = threshold
+		o.slowOpHistory = history
+	})
+}
+
+// WithEventHistory records the pebble flush, compaction, ingest, table deletion,
+// write stall, manifest and WAL events with the durations and sizes,
+// which are logged and the recent history ones kept for Events,
+// history defaults to defaultEventHistory if <= 0.
+// notice: not recorded if pebble options are set with WithPebbleOptions
+func WithEventHistory(history int) Option {
+	return newOption(func(o *options) {
+		if history <= 0 {
+			history = defaultEventHistory
+		}
+		o.eventHistory = history
+	})
+}
+
+// WithTracerProvider creates OpenTelemetry spans around StoreLog(s), GetLog,
+// DeleteRange and the stable store Set/Get, with the index range, entries
+// and bytes attributes, the spans are roots as raft passes no context.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return newOption(func(o *options) {
+		o.tracerProvider = tp
+	})
+}
+
+// WithMigrationProgress sets fn to report the format migration progress on open,
+// migrations are always logged by the logger.
+func WithMigrationProgress(fn func(MigrationProgress)) Option {
+	return newOption(func(o *options) {
+		o.migrationProgress = fn
+	})
+}
+
+// WithExpectedIdentity fails New with ErrIdentityMismatch if the store is bound
+// to another cluster or server, eg: pointed at another node's data dir,
+// the empty fields are not checked, the unbound fields are persisted on open.
+func WithExpectedIdentity(id Identity) Option {
+	return newOption(func(o *options) {
+		o.expectedIdentity = &id
+	})
+}
+
+// WithCloseTimeout sets the max time Close waits the in-flight calls,
+// the open app iterators and snapshots, defaults to defaultCloseTimeout if <= 0.
+func WithCloseTimeout(timeout time.Duration) Option {
+	return newOption(func(o *options) {
+		o.closeTimeout = timeout
+	})
+}
+
 func WithPebbleOptions(opts *pebble.Options) Option {
 	return newOption(func(o *options) {
 		o.pebbleOptions = opts
@@ -83,6 +277,8 @@ func getOptions(opts ...Option) *options {
 		config: GetDefaultRaftLogRocksDBConfig(),
 		logger: pebble.DefaultLogger,
 		fs:     vfs.Default,
+
+		monotonic: true,
 	}
 
 	for _, o := range opts {
@@ -1,25 +1,44 @@
 package raftpebble
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
 	"github.com/hashicorp/raft"
 	"github.com/lni/goutils/syncutil"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	// Prefix names to distingish between logs and conf
-	prefixLog  = []byte{0x00}
-	prefixConf = []byte{0x01}
+	// only used as iter bounds, keys are built by keys.go encoders
+	prefixLog  = []byte{prefixLogByte}
+	prefixConf = []byte{prefixConfByte}
 
 	// ErrKeyNotFound is an error indicating a given key does not exist
 	// for hashicorp raft vote meta stable get check, if err != nil && err.Error() != "not found"
 	ErrKeyNotFound = errors.New("not found")
+
+	// ErrNonMonotonicLogs is an error indicating a StoreLogs batch is not
+	// contiguous, or would leave a gap after the current LastIndex
+	ErrNonMonotonicLogs = errors.New("non-monotonic log indexes")
+
+	// ErrInvalidDeleteRange is an error indicating a DeleteRange would remove
+	// logs from the middle of the log, only prefix/suffix truncation allowed
+	ErrInvalidDeleteRange = errors.New("delete range is not a prefix or suffix of the log")
 )
 
 const (
 	maxLogFileSize = 1024 * 1024 * 128
+
+	defaultDiskCheckInterval = 10 * time.Second
 )
 
 // KV is a pebble based LogStore StableStore type.
@@ -27,8 +46,39 @@ type PebbleKVStore struct {
 	db    *pebble.DB
 	dbSet chan struct{}
 	event *eventListener
+	stats *logStats
+	// compacts the truncated logs, nil if disabled
+	compactor *compactor
+	// rejects log writes past the disk quota, nil if disabled
+	quota *quota
+	// rejects writes on low disk space, nil if disabled
+	watchdog *diskWatchdog
+	// fatal error from pebble, reject writes after it
+	failed atomic.Pointer[error]
+	// serializes the monotonic checks and the log writes, eg: raft truncates
+	// the logs from the snapshot goroutine
+	monotonicMu sync.Mutex
 
 	options *options
+	logger  pebble.Logger
+	// on-disk format version, see formatVersion
+	formatVersion uint64
+	// store UUID created on first open
+	storeID string
+	// WAL dir failover, nil if not enabled
+	walFS *walFailoverFS
+	// recent slow ops, nil if not enabled
+	slowOps *slowOps
+	// stops the disk health checks reporting DiskSlow
+	diskHealth io.Closer
+	// store op spans, nil if not enabled
+	tracer trace.Tracer
+	// structured store event logs, nil if the logger isn't an eventLogger
+	eventLog eventLogger
+	// recent pebble events, nil if not enabled
+	events *events
+	// open/closing/closed state and the in-flight calls
+	life *lifecycle
 
 	defaultWriteOpts *pebble.WriteOptions
 }
@@ -40,46 +90,71 @@ type LogDBCallback func(busy bool)
 type eventListener struct {
 	kv      *PebbleKVStore
 	stopper *syncutil.Stopper
+	// pending WAL failover, handled by the failover worker
+	walSwitched chan WALFailoverInfo
+	// pending LogDBCallback busy check, handled by the busy check worker
+	busyCheck chan struct{}
 }
 
 func (l *eventListener) close() {
 	l.stopper.Stop()
 }
 
+// notify signals the busy check worker, pebble calls the listener with
+// DB.mu held, so it must not block on the stopper or the db
 func (l *eventListener) notify() {
-	l.stopper.RunWorker(func() {
+	select {
+	case <-l.kv.dbSet:
+	default:
+		return
+	}
+	select {
+	case l.busyCheck <- struct{}{}:
+	default:
+	}
+}
+
+// runBusyCheck calls the LogDBCallback with the busy state on the notified events
+func (l *eventListener) runBusyCheck() {
+	memSizeThreshold := l.kv.options.config.KVWriteBufferSize *
+		l.kv.options.config.KVMaxWriteBufferNumber * 19 / 20
+	l0FileNumThreshold := l.kv.options.config.KVLevel0StopWritesTrigger - 1
+	for {
 		select {
-		case <-l.kv.dbSet:
-			if l.kv.options.callback != nil {
-				memSizeThreshold := l.kv.options.config.KVWriteBufferSize *
-					l.kv.options.config.KVMaxWriteBufferNumber * 19 / 20
-				l0FileNumThreshold := l.kv.options.config.KVLevel0StopWritesTrigger - 1
-				m := l.kv.db.Metrics()
-				busy := m.MemTable.Size >= memSizeThreshold ||
-					uint64(m.Levels[0].Sublevels) >= l0FileNumThreshold
-				l.kv.options.callback(busy)
+		case <-l.stopper.ShouldStop():
+			return
+		case <-l.busyCheck:
+			if l.kv.failure() != nil {
+				// the failed db is only closed
+				continue
 			}
-		default:
+			m := l.kv.db.Metrics()
+			busy := m.MemTable.Size >= memSizeThreshold ||
+				uint64(m.Levels[0].Sublevels) >= l0FileNumThreshold
+			l.kv.options.callback(busy)
 		}
-	})
+	}
 }
 
-func (l *eventListener) onCompactionEnd(pebble.CompactionInfo) {
+func (l *eventListener) onCompactionEnd(info pebble.CompactionInfo) {
 	l.notify()
+	l.recordCompaction(info)
 }
 
-func (l *eventListener) onFlushEnd(pebble.FlushInfo) {
+func (l *eventListener) onFlushEnd(info pebble.FlushInfo) {
 	l.notify()
+	l.recordFlush(info)
 }
 
-func (l *eventListener) onWALCreated(pebble.WALCreateInfo) {
+func (l *eventListener) onWALCreated(info pebble.WALCreateInfo) {
 	l.notify()
+	l.recordWALCreated(info)
 }
 
 // New uses the supplied config to open the Pebble db and prepare it
 // for using as a raft backend pebble kv store.
 // level no compression for raft meta/log store
-func New(options ...Option) (*PebbleKVStore, error) {
+func New(options ...Option) (_ *PebbleKVStore, err error) {
 	// config defined options
 	kvStoreOpts := getOptions(options...)
 	config := kvStoreOpts.config
@@ -117,21 +192,85 @@ func New(options ...Option) (*PebbleKVStore, error) {
 	}
 
 	kv := &PebbleKVStore{
-		options: kvStoreOpts,
-		dbSet:   make(chan struct{}),
+		options:          kvStoreOpts,
+		dbSet:            make(chan struct{}),
+		life:             newLifecycle(kvStoreOpts.closeTimeout),
+		defaultWriteOpts: &pebble.WriteOptions{Sync: kvStoreOpts.sync},
+	}
+	if kvStoreOpts.eventHistory > 0 {
+		kv.events = newEvents(kvStoreOpts.eventHistory)
+	}
+	if kvStoreOpts.diskQuota > 0 {
+		kv.quota = &quota{
+			max:        kvStoreOpts.diskQuota,
+			onExceeded: kvStoreOpts.onQuotaExceeded,
+		}
 	}
 	event := &eventListener{
-		kv:      kv,
-		stopper: syncutil.NewStopper(),
+		kv:          kv,
+		stopper:     syncutil.NewStopper(),
+		walSwitched: make(chan WALFailoverInfo, 1),
+		busyCheck:   make(chan struct{}, 1),
 	}
 	opts.EventListener = &pebble.EventListener{
-		WALCreated:    event.onWALCreated,
-		FlushEnd:      event.onFlushEnd,
-		CompactionEnd: event.onCompactionEnd,
+		WALCreated:      event.onWALCreated,
+		FlushEnd:        event.onFlushEnd,
+		CompactionEnd:   event.onCompactionEnd,
+		DiskSlow:        event.onDiskSlow,
+		TableIngested:   event.onTableIngested,
+		TableDeleted:    event.onTableDeleted,
+		WriteStallBegin: event.onWriteStallBegin,
+		WriteStallEnd:   event.onWriteStallEnd,
+		ManifestCreated: event.onManifestCreated,
+		ManifestDeleted: event.onManifestDeleted,
+		WALDeleted:      event.onWALDeleted,
+		BackgroundError: event.onBackgroundError,
 	}
 
 	if kvStoreOpts.pebbleOptions != nil {
-		opts = kvStoreOpts.pebbleOptions
+		// the logger and FS are wrapped below, so the caller's options can be reused
+		opts = kvStoreOpts.pebbleOptions.Clone()
+	}
+	if opts.Logger == nil {
+		opts.Logger = pebble.DefaultLogger
+	}
+	kv.eventLog, _ = opts.Logger.(eventLogger)
+	opts.Logger = fatalLogger{opts.Logger}
+	kv.logger = opts.Logger
+	if kvStoreOpts.tracerProvider != nil {
+		kv.tracer = kvStoreOpts.tracerProvider.Tracer(tracerName)
+	}
+	if kvStoreOpts.walSecondaryDir != "" {
+		if opts.FS == nil {
+			opts.FS = vfs.Default
+		}
+		primary := opts.WALDir
+		if primary == "" {
+			primary = kvStoreOpts.dir
+		}
+		if err := opts.FS.MkdirAll(kvStoreOpts.walSecondaryDir, 0755); err != nil {
+			return nil, err
+		}
+		kv.walFS = newWALFailoverFS(opts.FS, primary, kvStoreOpts.walSecondaryDir,
+			kvStoreOpts.walLatencyThreshold)
+		kv.walFS.onSlow = event.onWALSlow
+		if err := kv.walFS.checkOrphans(kvStoreOpts.dir); err != nil {
+			return nil, err
+		}
+		opts.FS = kv.walFS
+	}
+	if kvStoreOpts.slowOpThreshold > 0 {
+		kv.slowOps = newSlowOps(kvStoreOpts.slowOpThreshold, kvStoreOpts.slowOpHistory)
+		if opts.FS == nil {
+			opts.FS = vfs.Default
+		}
+		opts.FS, kv.diskHealth = vfs.WithDiskHealthChecks(opts.FS, kvStoreOpts.slowOpThreshold,
+			event.onDiskSlow)
+		defer func() {
+			if err != nil {
+				kv.diskHealth.Close()
+			}
+		}()
 	}
 
 	pdb, err := pebble.Open(kvStoreOpts.dir, opts)
@@ -140,9 +279,58 @@ func New(options ...Option) (*PebbleKVStore, error) {
 	}
 	cache.Unref()
 	kv.db = pdb
+	if err = kv.openFormat(formatVersion, migrations); err != nil {
+		return nil, FirstError(err, pdb.Close())
+	}
+	if err = kv.openIdentity(kvStoreOpts.expectedIdentity); err != nil {
+		return nil, FirstError(err, pdb.Close())
+	}
+	if kvStoreOpts.logStats {
+		kv.stats = newLogStats()
+		err = kv.openLogStats()
+	} else {
+		err = kv.dropLogStats()
+	}
+	if err != nil {
+		return nil, FirstError(err, pdb.Close())
+	}
 	kv.setEventListener(event)
-	//kv.defaultWriteOpts = &pebble.WriteOptions{Sync: true}
-	kv.defaultWriteOpts = &pebble.WriteOptions{Sync: false}
+	if kv.stats != nil && kvStoreOpts.logStatsInterval > 0 {
+		event.stopper.RunWorker(func() {
+			kv.runLogStatsMetrics(kvStoreOpts.logStatsInterval)
+		})
+	}
+	if kvStoreOpts.minFreeDisk > 0 {
+		kv.watchdog = &diskWatchdog{
+			fs:       opts.FS,
+			dirs:     []string{kvStoreOpts.dir},
+			minFree:  kvStoreOpts.minFreeDisk,
+			interval: kvStoreOpts.diskCheckInterval,
+			onChange: kvStoreOpts.onDiskSpaceChange,
+		}
+		if kv.watchdog.fs == nil {
+			kv.watchdog.fs = vfs.Default
+		}
+		if opts.WALDir != "" && opts.WALDir != kvStoreOpts.dir {
+			kv.watchdog.dirs = append(kv.watchdog.dirs, opts.WALDir)
+		}
+		if kv.walFS != nil {
+			kv.watchdog.dirs = append(kv.watchdog.dirs, kv.walFS.secondary)
+		}
+		if kv.watchdog.interval <= 0 {
+			kv.watchdog.interval = defaultDiskCheckInterval
+		}
+		// check before accepting writes
+		kv.checkDiskWatchdog()
+		event.stopper.RunWorker(kv.runDiskWatchdog)
+	}
+	if kvStoreOpts.compactMinEntries > 0 {
+		kv.compactor = newCompactor(kvStoreOpts.compactMinEntries, kvStoreOpts.compactMinInterval)
+		event.stopper.RunWorker(kv.runCompactor)
+	}
+	if kv.walFS != nil {
+		event.stopper.RunWorker(kv.runWALFailover)
+	}
 	return kv, nil
 }
 
@@ -152,17 +340,14 @@ func (s *PebbleKVStore) setEventListener(event *eventListener) {
 	}
 	s.event = event
 	close(s.dbSet)
+	if s.options.callback != nil {
+		event.stopper.RunWorker(event.runBusyCheck)
+	}
 	// force a WALCreated event as the one issued when opening the DB didn't get
 	// handled
 	event.onWALCreated(pebble.WALCreateInfo{})
 }
 
-// Close the Raft log
-func (s *PebbleKVStore) Close() error {
-	s.event.close()
-	return s.db.Close()
-}
-
 // log store
 
 // FirstIndex returns the first known index from the Raft log.
@@ -171,6 +356,12 @@ func (s *PebbleKVStore) Close() error {
 // so use lowerBound,UpperBound for iter prefixLog
 // notice: if not found return 0, nil
 func (s *PebbleKVStore) FirstIndex() (first uint64, err error) {
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
 	iter := s.db.NewIter(&pebble.IterOptions{
 		LowerBound: prefixLog,
 		UpperBound: prefixConf,
@@ -182,7 +373,7 @@ func (s *PebbleKVStore) FirstIndex() (first uint64, err error) {
 	}()
 
 	if iter.First() {
-		first = bytesToUint64(iter.Key()[len(prefixLog):])
+		first, err = decodeLogKey(iter.Key())
 	}
 
 	return
@@ -194,6 +385,12 @@ func (s *PebbleKVStore) FirstIndex() (first uint64, err error) {
 // so use lowerBound,UpperBound for iter prefixLog
 // notice: if not found return 0, nil
 func (s *PebbleKVStore) LastIndex() (last uint64, err error) {
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
 	iter := s.db.NewIter(&pebble.IterOptions{
 		LowerBound: prefixLog,
 		UpperBound: prefixConf,
@@ -205,7 +402,7 @@ func (s *PebbleKVStore) LastIndex() (last uint64, err error) {
 	}()
 
 	if iter.Last() {
-		last = bytesToUint64(iter.Key()[len(prefixLog):])
+		last, err = decodeLogKey(iter.Key())
 	}
 
 	return
@@ -214,7 +411,21 @@ func (s *PebbleKVStore) LastIndex() (last uint64, err error) {
 // GetLog gets a log entry from Pebble at a given index.
 // notice: if index log not found return raft ErrLogNotFound
 func (s *PebbleKVStore) GetLog(index uint64, log *raft.Log) (err error) {
-	key := append(prefixLog, uint64ToBytes(index)...)
+	var span trace.Span
+	if s.tracer != nil {
+		span = s.startSpan(spanGetLog, attrIndex.Int64(int64(index)))
+		defer endSpan(span, &err)
+	}
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
+	// db.Get key escapes, so use a pooled buffer, put after closer.Close
+	kb := getKeyBuf()
+	key := encodeLogKey(kb.b[:0], index)
+	defer putKeyBuf(kb, key)
 	val, closer, err := s.db.Get(key)
 	defer func() {
 		if closer != nil {
@@ -228,62 +439,319 @@ func (s *PebbleKVStore) GetLog(index uint64, log *raft.Log) (err error) {
 	if val == nil {
 		return raft.ErrLogNotFound
 	}
+	if span != nil {
+		span.SetAttributes(attrBytes.Int(len(val)))
+	}
 
 	return decodeMsgPack(val, log)
 }
 
+// IsMonotonic implements raft.MonotonicLogStore,
+// the store can't tolerate gaps between the Index values of consecutive logs.
+func (s *PebbleKVStore) IsMonotonic() bool {
+	return s.options.monotonic
+}
+
+// checkMonotonic checks the logs are contiguous and follow the LastIndex,
+// an empty log can start from any index.
+func (s *PebbleKVStore) checkMonotonic(logs []*raft.Log) error {
+	if !s.options.monotonic || len(logs) == 0 {
+		return nil
+	}
+
+	if err := checkContiguous(logs); err != nil {
+		return err
+	}
+
+	// index 0 is a valid log index, so LastIndex 0 can't tell empty log
+	if s.isEmptyLog() {
+		return nil
+	}
+	last, err := s.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	return checkFollows(logs, last)
+}
+
+// checkContiguous checks the logs batch has no gap
+func checkContiguous(logs []*raft.Log) error {
+	for i := 1; i < len(logs); i++ {
+		if logs[i].Index != logs[i-1].Index+1 {
+			return fmt.Errorf("%w: index %d follows %d in batch",
+				ErrNonMonotonicLogs, logs[i].Index, logs[i-1].Index)
+		}
+	}
+	return nil
+}
+
+// checkFollows checks the logs batch follows the last index of a non-empty log
+func checkFollows(logs []*raft.Log, last uint64) error {
+	if logs[0].Index != last+1 {
+		return fmt.Errorf("%w: index %d follows last index %d",
+			ErrNonMonotonicLogs, logs[0].Index, last)
+	}
+	return nil
+}
+
+// isEmptyLog returns true if no log stored
+func (s *PebbleKVStore) isEmptyLog() bool {
+	iter := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefixLog,
+		UpperBound: prefixConf,
+	})
+	defer iter.Close()
+
+	return !iter.First()
+}
+
 // StoreLog stores a single raft log.
 func (s *PebbleKVStore) StoreLog(log *raft.Log) (err error) {
 	//return s.StoreLogs([]*raft.Log{log})
+	if s.tracer != nil {
+		span := s.startSpan(spanStoreLog, logsAttrs([]*raft.Log{log})...)
+		defer endSpan(span, &err)
+	}
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+	defer s.observeLogs(SlowOpStoreLog, time.Now(), log)
+
+	if err = s.failure(); err != nil {
+		return
+	}
+	if err = s.checkDiskSpace(); err != nil {
+		return
+	}
+	if s.options.monotonic {
+		// the check reads the log bounds, which the concurrent writes move
+		s.monotonicMu.Lock()
+		defer s.monotonicMu.Unlock()
+	}
+	if err = s.checkMonotonic([]*raft.Log{log}); err != nil {
+		return
+	}
 	return s.storeLog(log)
 }
 
 // storeLog stores a single raft log.
 func (s *PebbleKVStore) storeLog(log *raft.Log) (err error) {
-	key := append(prefixLog, uint64ToBytes(log.Index)...)
-	val, err := encodeMsgPack(log)
+	key := logKey(log.Index)
+	e := getEncoder()
+	defer putEncoder(e)
+	val, err := e.encode(log)
 	if err != nil {
 		return err
 	}
 
-	//return s.db.Set(key, val.Bytes(), &pebble.WriteOptions{Sync: true})
-	return s.db.Set(key, val.Bytes(), &pebble.WriteOptions{Sync: false})
+	if s.quota != nil {
+		if err = s.reserveQuota(uint64(len(key) + len(val))); err != nil {
+			return err
+		}
+	}
+	// pebble copies key and val into the batch, so the buffers can be reused
+	if s.stats == nil {
+		return s.db.Set(key[:], val, s.defaultWriteOpts)
+	}
+
+	wb := s.db.NewBatch()
+	defer func() {
+		err = FirstError(err, wb.Close())
+	}()
+	if err = wb.Set(key[:], val, nil); err != nil {
+		return err
+	}
+	s.stats.writeMu.Lock()
+	defer s.stats.writeMu.Unlock()
+	u := make(logStatsUpdate, 1)
+	s.stats.stage(u, log, uint64(len(key)+len(val)))
+
+	return s.applyLogStats(wb, u)
 }
 
 // StoreLogs stores a set of raft logs.
 func (s *PebbleKVStore) StoreLogs(logs []*raft.Log) (err error) {
+	if s.tracer != nil {
+		span := s.startSpan(spanStoreLogs, logsAttrs(logs)...)
+		defer endSpan(span, &err)
+	}
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+	defer s.observeLogs(SlowOpStoreLogs, time.Now(), logs...)
+
+	if err = s.failure(); err != nil {
+		return
+	}
+	if err = s.checkDiskSpace(); err != nil {
+		return
+	}
+	if s.options.monotonic {
+		// the check reads the log bounds, which the concurrent writes move
+		s.monotonicMu.Lock()
+		defer s.monotonicMu.Unlock()
+	}
+	if err = s.checkMonotonic(logs); err != nil {
+		return
+	}
+
 	wb := s.db.NewBatch()
 	defer func() {
 		err = FirstError(err, wb.Close())
 	}()
 
+	// one encoder buffer is reused for the batch, as wb.Set copies
+	e := getEncoder()
+	defer putEncoder(e)
 	for _, log := range logs {
-		key := append(prefixLog, uint64ToBytes(log.Index)...)
-		val, err := encodeMsgPack(log)
+		key := logKey(log.Index)
+		val, err := e.encode(log)
 		if err != nil {
 			return err
 		}
 
-		//err = wb.Set(key, val.Bytes(), &pebble.WriteOptions{Sync: true})
-		err = wb.Set(key, val.Bytes(), &pebble.WriteOptions{Sync: false})
+		err = wb.Set(key[:], val, s.defaultWriteOpts)
 		if err != nil {
 			return err
 		}
+		if s.stats != nil {
+			e.sizes = append(e.sizes, uint64(len(key)+len(val)))
+		}
+	}
+
+	if s.quota != nil {
+		if err = s.reserveQuota(uint64(wb.Len())); err != nil {
+			return
+		}
+	}
+	if s.stats == nil {
+		return s.db.Apply(wb, s.defaultWriteOpts)
+	}
+
+	s.stats.writeMu.Lock()
+	defer s.stats.writeMu.Unlock()
+	u := make(logStatsUpdate)
+	for i := range e.sizes {
+		s.stats.stage(u, logs[i], e.sizes[i])
 	}
 
-	//return s.db.Apply(wb, &pebble.WriteOptions{Sync: true})
-	return s.db.Apply(wb, &pebble.WriteOptions{Sync: false})
+	return s.applyLogStats(wb, u)
 }
 
 // DeleteRange deletes logs within a given range inclusively.
+// notice: if monotonic, only prefix or suffix truncation allowed
 func (s *PebbleKVStore) DeleteRange(min, max uint64) (err error) {
-	//wo := &pebble.WriteOptions{Sync: true}
-	wo := &pebble.WriteOptions{Sync: false}
-	fk := append(prefixLog, uint64ToBytes(min)...)
-	lk := append(prefixLog, uint64ToBytes(max+1)...)
+	if s.tracer != nil {
+		span := s.startSpan(spanDeleteRange, deleteRangeAttrs(min, max)...)
+		defer endSpan(span, &err)
+	}
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
+	if err = s.failure(); err != nil {
+		return
+	}
+	if s.options.monotonic {
+		// the check reads the log bounds, which the concurrent writes move
+		s.monotonicMu.Lock()
+		defer s.monotonicMu.Unlock()
+	}
+	if err = s.checkDeleteRange(min, max); err != nil {
+		return
+	}
+
+	var last uint64
+	if s.compactor != nil {
+		if last, err = s.LastIndex(); err != nil {
+			return
+		}
+	}
+
+	wo := s.defaultWriteOpts
+	fk, lk := logKey(min), logKey(max+1)
+
+	//err = s.deleteRange(fk, lk, wo)
+	if s.stats == nil {
+		err = s.db.DeleteRange(fk[:], lk[:], wo)
+	} else {
+		err = s.deleteLogsWithStats(fk[:], lk[:], min, max)
+	}
+	if err != nil {
+		return
+	}
+	if s.compactor != nil {
+		// no logs after the last index to reclaim
+		if max > last {
+			max = last
+		}
+		s.compactor.add(min, max)
+	}
+	if s.quota != nil {
+		s.refreshQuota()
+	}
+
+	return
+}
+
+// deleteLogsWithStats deletes the logs [fk,lk) with the rebuilt summaries
+// of the truncated ranges in one batch.
+func (s *PebbleKVStore) deleteLogsWithStats(fk, lk []byte, min, max uint64) (err error) {
+	wb := s.db.NewIndexedBatch()
+	defer func() {
+		err = FirstError(err, wb.Close())
+	}()
+	if err = wb.DeleteRange(fk, lk, nil); err != nil {
+		return
+	}
 
-	//return s.deleteRange(fk, lk, wo)
-	return s.db.DeleteRange(fk, lk, wo)
+	s.stats.writeMu.Lock()
+	defer s.stats.writeMu.Unlock()
+	u := make(logStatsUpdate)
+	if err = s.rebuildLogStats(wb, min, max, u); err != nil {
+		return
+	}
+
+	return s.applyLogStats(wb, u)
+}
+
+// checkDeleteRange checks [min,max] covers the first or last log,
+// deleting from the middle would leave a gap.
+func (s *PebbleKVStore) checkDeleteRange(min, max uint64) error {
+	if !s.options.monotonic {
+		return nil
+	}
+	if min > max {
+		return fmt.Errorf("%w: min %d > max %d", ErrInvalidDeleteRange, min, max)
+	}
+
+	first, err := s.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := s.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	return checkDeleteBounds(min, max, first, last)
+}
+
+// checkDeleteBounds checks [min,max] covers the first or last of [first,last]
+func checkDeleteBounds(min, max, first, last uint64) error {
+	if min <= first || max >= last {
+		return nil
+	}
+
+	return fmt.Errorf("%w: [%d,%d] inside [%d,%d]",
+		ErrInvalidDeleteRange, min, max, first, last)
 }
 
 // deleteRange deletes logs within a given range [fk,lk)
@@ -305,30 +773,38 @@ func (s *PebbleKVStore) deleteRange(fk, lk []byte, wo *pebble.WriteOptions) (err
 
 // Set is used to set a key/value set outside of the raft log.
 func (s *PebbleKVStore) Set(key []byte, val []byte) (err error) {
-	confKey := append(prefixConf, key...)
+	if s.tracer != nil {
+		span := s.startSpan(spanSet, attrKey.String(string(key)), attrBytes.Int(len(val)))
+		defer endSpan(span, &err)
+	}
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+	defer s.observeSet(time.Now(), key, val)
+
+	if err = s.failure(); err != nil {
+		return
+	}
+	// pebble copies the key into the batch
+	kb := getKeyBuf()
+	confKey := encodeStableKey(kb.b[:0], key)
+	defer putKeyBuf(kb, confKey)
 
-	//return s.db.Set(confKey, val, &pebble.WriteOptions{Sync: true})
-	return s.db.Set(confKey, val, &pebble.WriteOptions{Sync: false})
+	return s.db.Set(confKey, val, s.defaultWriteOpts)
 }
 
-// Get is used to retrieve a value from the k/v store by key
+// Get is used to retrieve a value from the k/v store by key,
+// the value is copied out of pebble owned memory before closer.Close,
+// so it never changes underneath the caller, use GetValue to read without copy.
+// the copy is a new slice, not pooled, as the caller owns it and never puts it back,
+// only the key buffer is pooled.
 // notice: if key/val not found return ErrKeyNotFound
 func (s *PebbleKVStore) Get(key []byte) (value []byte, err error) {
-	confKey := append(prefixConf, key...)
-	err = s.GetValue(confKey, func(val []byte) error {
-		if val == nil {
-			err = ErrKeyNotFound
-			return err
-		}
-
-		value = val
-		// https://github.com/hashicorp/raft/blob/v1.5.0/raft.go#L1623 no modify
-		// if have modify op, use copy, but add some GC
-		/*
-			value = make([]byte, len(val))
-			copy(value, val)
-		*/
-
+	err = s.getConf(key, func(val []byte) error {
+		value = make([]byte, len(val))
+		copy(value, val)
 		return nil
 	})
 
@@ -337,28 +813,58 @@ func (s *PebbleKVStore) Get(key []byte) (value []byte, err error) {
 
 // SetUint64 is like Set, but handles uint64 values
 func (s *PebbleKVStore) SetUint64(key []byte, val uint64) error {
-	return s.Set(key, uint64ToBytes(val))
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], val)
+	return s.Set(key, b[:])
 }
 
 // GetUint64 is like Get, but return uint64 values
 func (s *PebbleKVStore) GetUint64(key []byte) (term uint64, err error) {
-	confKey := append(prefixConf, key...)
-	err = s.GetValue(confKey, func(val []byte) error {
-		if val == nil {
-			err = ErrKeyNotFound
-			return err
+	err = s.getConf(key, func(val []byte) error {
+		if len(val) != 8 {
+			return fmt.Errorf("invalid uint64 value of key %q, len %d", key, len(val))
 		}
-
 		term = bytesToUint64(val)
-
 		return nil
 	})
 
 	return
 }
 
-// GetValue defer closer.Close to do op safely when modify get value
+// getConf calls op with the pebble owned value of prefixConf key,
+// the key is built in a pooled buffer as pebble doesn't retain it.
+// notice: if key/val not found return ErrKeyNotFound
+func (s *PebbleKVStore) getConf(key []byte, op func([]byte) error) (err error) {
+	if s.tracer != nil {
+		span := s.startSpan(spanGet, attrKey.String(string(key)))
+		defer endSpan(span, &err)
+		get := op
+		op = func(val []byte) error {
+			span.SetAttributes(attrBytes.Int(len(val)))
+			return get(val)
+		}
+	}
+	kb := getKeyBuf()
+	confKey := encodeStableKey(kb.b[:0], key)
+	defer putKeyBuf(kb, confKey)
+
+	return s.GetValue(confKey, func(val []byte) error {
+		if val == nil {
+			return ErrKeyNotFound
+		}
+		return op(val)
+	})
+}
+
+// GetValue calls op with the pebble owned value, nil if not found,
+// defer closer.Close so the value is only valid inside op, zero-copy.
 func (s *PebbleKVStore) GetValue(key []byte, op func([]byte) error) (err error) {
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
 	val, closer, err := s.db.Get(key)
 	if err != nil && err != pebble.ErrNotFound {
 		return
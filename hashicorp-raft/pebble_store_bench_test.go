@@ -3,6 +3,7 @@ package raftpebble
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/raft"
 	raftbench "github.com/hashicorp/raft/bench"
@@ -64,7 +65,8 @@ func BenchmarkPebbleKVStoreStore_StoreLogs(b *testing.B) {
 }
 
 func BenchmarkPebbleKVStoreStore_DeleteRange(b *testing.B) {
-	store, walDir, dir := testPebbleKVStore(b)
+	// raftbench stores logs with gaps
+	store, walDir, dir := testPebbleKVStore(b, WithMonotonic(false))
 	defer func() {
 		store.Close()
 		os.RemoveAll(walDir)
@@ -190,3 +192,172 @@ func BenchmarkGetLog(b *testing.B) {
 		store.GetLog(uint64(n), ralog)
 	}
 }
+
+func BenchmarkGetLogView(b *testing.B) {
+	store, walDir, dir := testPebbleKVStore(b)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	for n := 0; n < b.N; n++ {
+		store.StoreLogs([]*raft.Log{
+			{
+				Index: uint64(n),
+				Term:  uint64(n),
+			},
+		})
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		store.GetLogView(uint64(n), func(LogView) error {
+			return nil
+		})
+	}
+}
+
+// allocsTarget fails the benchmark if op allocates more than target per run,
+// pebble internal allocs are included, so the targets leave some headroom.
+func allocsTarget(b *testing.B, target float64, op func()) {
+	b.Helper()
+	if allocs := testing.AllocsPerRun(100, op); allocs > target {
+		b.Errorf("allocs/op %.1f exceeds target %.1f", allocs, target)
+	}
+}
+
+func benchLog(index uint64) *raft.Log {
+	return &raft.Log{
+		Index:      index,
+		Term:       1,
+		Type:       raft.LogCommand,
+		Data:       make([]byte, 128),
+		AppendedAt: time.Now(),
+	}
+}
+
+func BenchmarkEncodeLog(b *testing.B) {
+	log := benchLog(1)
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			e := getEncoder()
+			e.encode(log)
+			putEncoder(e)
+		}
+		// codec struct encode and AppendedAt MarshalBinary, new encoder is 24
+		allocsTarget(b, 4, func() {
+			e := getEncoder()
+			e.encode(log)
+			putEncoder(e)
+		})
+	})
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			encodeMsgPack(log)
+		}
+	})
+}
+
+func BenchmarkDecodeLog(b *testing.B) {
+	e := getEncoder()
+	val, _ := e.encode(benchLog(1))
+	log := new(raft.Log)
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		decodeMsgPack(val, log)
+	}
+	// codec field names, Data copy and AppendedAt, new decoder is 23
+	allocsTarget(b, 13, func() {
+		decodeMsgPack(val, log)
+	})
+}
+
+func BenchmarkLogKey(b *testing.B) {
+	b.ReportAllocs()
+	var k [logKeyLen]byte
+	for n := 0; n < b.N; n++ {
+		k = logKey(uint64(n))
+	}
+	_ = k
+	allocsTarget(b, 0, func() {
+		kb := getKeyBuf()
+		putKeyBuf(kb, encodeLogKey(kb.b[:0], 1))
+	})
+}
+
+func BenchmarkStoreLogAllocs(b *testing.B) {
+	store, walDir, dir := testPebbleKVStore(b)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	log := benchLog(0)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		log.Index++
+		store.StoreLog(log)
+	}
+	allocsTarget(b, 12, func() {
+		log.Index++
+		store.StoreLog(log)
+	})
+}
+
+func BenchmarkStoreLogsAllocs(b *testing.B) {
+	store, walDir, dir := testPebbleKVStore(b)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// the batch encoding reuses one buffer, only codec allocs grow with batch size
+	logs := make([]*raft.Log, 64)
+	for i := range logs {
+		logs[i] = benchLog(uint64(i))
+	}
+	next := func() {
+		for _, log := range logs {
+			log.Index += uint64(len(logs))
+		}
+	}
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		next()
+		store.StoreLogs(logs)
+	}
+	allocsTarget(b, float64(5*len(logs)), func() {
+		next()
+		store.StoreLogs(logs)
+	})
+}
+
+func BenchmarkGetLogAllocs(b *testing.B) {
+	store, walDir, dir := testPebbleKVStore(b)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	for i := uint64(1); i <= 1024; i++ {
+		store.StoreLog(benchLog(i))
+	}
+
+	log := new(raft.Log)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		store.GetLog(uint64(n%1024)+1, log)
+	}
+	allocsTarget(b, 16, func() {
+		store.GetLog(512, log)
+	})
+}
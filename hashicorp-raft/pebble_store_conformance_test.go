@@ -0,0 +1,29 @@
+package raftpebble
+
+import (
+	"testing"
+
+	"github.com/weedge/raft-pebble/storetest"
+)
+
+func testConformance(t *testing.T, opts ...Option) {
+	storetest.Run(t, func(t testing.TB, dir string) storetest.Store {
+		store, err := New(append([]Option{WithDbDirPath(dir)}, opts...)...)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	})
+}
+
+func TestPebbleKVStore_Conformance(t *testing.T) {
+	testConformance(t)
+}
+
+func TestPebbleKVStore_Conformance_NonMonotonic(t *testing.T) {
+	testConformance(t, WithMonotonic(false))
+}
+
+func TestPebbleKVStore_Conformance_SyncLogStats(t *testing.T) {
+	testConformance(t, WithSync(true), WithLogStats(0))
+}
@@ -0,0 +1,130 @@
+package raftpebble
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stressValue is a self-describing value: key gen repeated, easy to verify
+func stressValue(key int, gen int, size int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("k%d-g%d;", key, gen)), size)
+}
+
+func TestPebbleKVStore_Get_Stress(t *testing.T) {
+	// small memtables, so flushes free the memory Get values were read from
+	config := GetDefaultRaftLogRocksDBConfig()
+	config.KVWriteBufferSize = 64 * 1024
+	store, walDir, dir := testPebbleKVStore(t, WithConfig(config))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	const keys = 8
+	for k := 0; k < keys; k++ {
+		err := store.Set([]byte(fmt.Sprintf("key%d", k)), stressValue(k, 0, 16))
+		assert.Nil(t, err)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, 16)
+
+	// writers overwrite keys with new generations, and flush
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for gen := 1; ; gen++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := (gen + w) % keys
+				if err := store.Set([]byte(fmt.Sprintf("key%d", k)), stressValue(k, gen, 16+gen%64)); err != nil {
+					errs <- err
+					return
+				}
+				if gen%200 == 0 {
+					if err := store.db.Flush(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	// readers keep the returned values while keys are overwritten,
+	// and check they never change
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			var held [][]byte
+			var snapshots [][]byte
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					for j := range held {
+						if !bytes.Equal(held[j], snapshots[j]) {
+							errs <- fmt.Errorf("held value changed: %q != %q", held[j], snapshots[j])
+							return
+						}
+					}
+					return
+				default:
+				}
+				k := (i + r) % keys
+				val, err := store.Get([]byte(fmt.Sprintf("key%d", k)))
+				if err != nil {
+					errs <- err
+					return
+				}
+				snapshot := append([]byte(nil), val...)
+				prefix := []byte(fmt.Sprintf("k%d-g", k))
+				if !bytes.HasPrefix(val, prefix) {
+					errs <- fmt.Errorf("bad value of key%d: %q", k, val)
+					return
+				}
+				if len(held) < 1000 {
+					held = append(held, val)
+					snapshots = append(snapshots, snapshot)
+				}
+			}
+		}(r)
+	}
+
+	time.Sleep(time.Second)
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestPebbleKVStore_GetUint64_Invalid(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	err := store.Set([]byte("short"), []byte("abc"))
+	assert.Nil(t, err)
+
+	// a non uint64 value returns error instead of panic
+	_, err = store.GetUint64([]byte("short"))
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, ErrKeyNotFound)
+}
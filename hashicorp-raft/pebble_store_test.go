@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/cockroachdb/pebble/vfs"
@@ -18,7 +19,7 @@ func mockCallBack(busy bool) {
 	fmt.Printf("busy %t\n", busy)
 }
 
-func testPebbleKVStore(t testing.TB) (kvStore *PebbleKVStore, walDir, dir string) {
+func testPebbleKVStore(t testing.TB, opts ...Option) (kvStore *PebbleKVStore, walDir, dir string) {
 	dir, err := os.MkdirTemp("", "raft-pebble")
 	if err != nil {
 		t.Fatalf("err. %s", err)
@@ -32,9 +33,9 @@ func testPebbleKVStore(t testing.TB) (kvStore *PebbleKVStore, walDir, dir string
 	os.RemoveAll(walDir)
 
 	if os.Getenv("mock") == "" {
-		kvStore, err = New(WithDbDirPath(dir))
+		kvStore, err = New(append([]Option{WithDbDirPath(dir)}, opts...)...)
 	} else {
-		kvStore, err = New(
+		kvStore, err = New(append([]Option{
 			WithConfig(GetDefaultRaftLogRocksDBConfig()),
 			WithLogger(pebble.DefaultLogger),
 			WithFS(vfs.Default),
@@ -42,7 +43,7 @@ func testPebbleKVStore(t testing.TB) (kvStore *PebbleKVStore, walDir, dir string
 			WithDbDirPath(dir),
 			WithLogDBCallback(mockCallBack),
 			WithPebbleOptions(nil),
-		)
+		}, opts...)...)
 	}
 
 	if err != nil {
@@ -52,6 +53,24 @@ func testPebbleKVStore(t testing.TB) (kvStore *PebbleKVStore, walDir, dir string
 	return kvStore, walDir, dir
 }
 
+// reopenTestPebbleKVStore closes the store and opens it again on the same dirs
+func reopenTestPebbleKVStore(t testing.TB, store *PebbleKVStore, opts ...Option) *PebbleKVStore {
+	if err := store.Close(); err != nil {
+		t.Fatalf("err. %s", err)
+	}
+
+	kvStore, err := New(append([]Option{
+		WithFS(store.options.fs),
+		WithWalDirPath(store.options.walDir),
+		WithDbDirPath(store.options.dir),
+	}, opts...)...)
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+
+	return kvStore
+}
+
 func TestPebbleKVStore_Implements(t *testing.T) {
 	var store interface{} = &PebbleKVStore{}
 	if _, ok := store.(raft.StableStore); !ok {
@@ -62,6 +81,26 @@ func TestPebbleKVStore_Implements(t *testing.T) {
 	}
 }
 
+func TestPebbleKVStore_PebbleOptionsReused(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raft-pebble")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fs := vfs.NewMem()
+	opts := &pebble.Options{FS: fs, Logger: pebble.DefaultLogger, FormatMajorVersion: pebble.FormatNewest}
+	for i := 0; i < 2; i++ {
+		store, err := New(WithDbDirPath(dir), WithPebbleOptions(opts),
+			WithSlowOpThreshold(time.Second, 0))
+		assert.Nil(t, err)
+		assert.Nil(t, store.StoreLog(&raft.Log{Index: uint64(i + 1)}))
+		assert.Nil(t, store.Close())
+
+		// the caller's options are not wrapped
+		assert.Equal(t, vfs.FS(fs), opts.FS)
+		assert.Equal(t, pebble.Logger(pebble.DefaultLogger), opts.Logger)
+	}
+}
+
 func TestPebbleKVStore_Empty(t *testing.T) {
 	store, walDir, dir := testPebbleKVStore(t)
 	defer func() {
@@ -446,14 +485,10 @@ func TestPebbleKVStore_Set_Get(t *testing.T) {
 			if !bytes.Equal(val, v) {
 				t.Fatalf("i:%d key: %s get: %s want: %s", i, k, val, v)
 			}
-			// test pebble.DB get from LazyValue.Value, modify
-			// https://github.com/hashicorp/raft/blob/v1.5.0/raft.go#L1623 no modify
-			// if have modify op, Get use copy, open to test
-			/*
-				if len(val) > 0 {
-					val[0] = 0x1
-				}
-			*/
+			// Get returns a copy, modify it doesn't change the stored value
+			if len(val) > 0 {
+				val[0] = 0x1
+			}
 		}
 	}
 }
@@ -561,3 +596,135 @@ func TestPebbleKVStore_RaftLogOp(t *testing.T) {
 	assert.Nil(t, err)
 	assert.EqualValues(t, 11, logptr.Index)
 }
+
+func TestPebbleKVStore_IsMonotonic(t *testing.T) {
+	var store interface{} = &PebbleKVStore{}
+	if _, ok := store.(raft.MonotonicLogStore); !ok {
+		t.Fatalf("PebbleKVStore does not implement raft.MonotonicLogStore")
+	}
+
+	kvStore, walDir, dir := testPebbleKVStore(t)
+	assert.True(t, kvStore.IsMonotonic())
+	kvStore.Close()
+	os.RemoveAll(walDir)
+	os.RemoveAll(dir)
+
+	kvStore, walDir, dir = testPebbleKVStore(t, WithMonotonic(false))
+	assert.False(t, kvStore.IsMonotonic())
+	kvStore.Close()
+	os.RemoveAll(walDir)
+	os.RemoveAll(dir)
+}
+
+func TestPebbleKVStore_StoreLogs_NonContiguous(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Data: []byte("log1")},
+		{Index: 3, Term: 1, Data: []byte("log3")},
+	}
+	err := store.StoreLogs(logs)
+	assert.ErrorIs(t, err, ErrNonMonotonicLogs)
+
+	// nothing stored from the rejected batch
+	err = store.GetLog(1, new(raft.Log))
+	assert.ErrorIs(t, err, raft.ErrLogNotFound)
+
+	// descending and duplicate indexes are not contiguous either
+	err = store.StoreLogs([]*raft.Log{{Index: 2}, {Index: 1}})
+	assert.ErrorIs(t, err, ErrNonMonotonicLogs)
+	err = store.StoreLogs([]*raft.Log{{Index: 1}, {Index: 1}})
+	assert.ErrorIs(t, err, ErrNonMonotonicLogs)
+}
+
+func TestPebbleKVStore_StoreLogs_GapAfterLastIndex(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// an empty log can start from any index, eg: after snapshot restore
+	err := store.StoreLogs([]*raft.Log{{Index: 5}, {Index: 6}})
+	assert.Nil(t, err)
+
+	err = store.StoreLogs([]*raft.Log{{Index: 8}})
+	assert.ErrorIs(t, err, ErrNonMonotonicLogs)
+	err = store.StoreLog(&raft.Log{Index: 8})
+	assert.ErrorIs(t, err, ErrNonMonotonicLogs)
+
+	// overwrite stored index is not following LastIndex
+	err = store.StoreLogs([]*raft.Log{{Index: 6}})
+	assert.ErrorIs(t, err, ErrNonMonotonicLogs)
+
+	err = store.StoreLog(&raft.Log{Index: 7})
+	assert.Nil(t, err)
+	err = store.StoreLogs([]*raft.Log{{Index: 8}, {Index: 9}})
+	assert.Nil(t, err)
+
+	idx, err := store.LastIndex()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 9, idx)
+
+	// after delete all logs, can start from any index again
+	err = store.DeleteRange(5, 9)
+	assert.Nil(t, err)
+	err = store.StoreLogs([]*raft.Log{{Index: 100}})
+	assert.Nil(t, err)
+}
+
+func TestPebbleKVStore_DeleteRange_Middle(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	var logs []*raft.Log
+	for i := 1; i <= 10; i++ {
+		logs = append(logs, &raft.Log{Index: uint64(i), Term: 1})
+	}
+	err := store.StoreLogs(logs)
+	assert.Nil(t, err)
+
+	err = store.DeleteRange(3, 5)
+	assert.ErrorIs(t, err, ErrInvalidDeleteRange)
+	err = store.DeleteRange(5, 3)
+	assert.ErrorIs(t, err, ErrInvalidDeleteRange)
+	// nothing deleted
+	err = store.GetLog(4, new(raft.Log))
+	assert.Nil(t, err)
+
+	// prefix truncation
+	err = store.DeleteRange(1, 3)
+	assert.Nil(t, err)
+	idx, err := store.FirstIndex()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 4, idx)
+
+	// suffix truncation
+	err = store.DeleteRange(8, 10)
+	assert.Nil(t, err)
+	idx, err = store.LastIndex()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 7, idx)
+
+	// gap is allowed if not monotonic
+	store.Close()
+	os.RemoveAll(walDir)
+	os.RemoveAll(dir)
+	store, walDir, dir = testPebbleKVStore(t, WithMonotonic(false))
+	err = store.StoreLogs(logs)
+	assert.Nil(t, err)
+	err = store.DeleteRange(3, 5)
+	assert.Nil(t, err)
+	err = store.StoreLogs([]*raft.Log{{Index: 20}})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,39 @@
+package raftpebble
+
+import "sync"
+
+// ring is a bounded history, the oldest items are overwritten
+type ring[T any] struct {
+	mu    sync.Mutex
+	items []T
+	next  int
+	full  bool
+}
+
+func newRing[T any](size int) *ring[T] {
+	return &ring[T]{items: make([]T, size)}
+}
+
+func (r *ring[T]) add(item T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.items[r.next] = item
+	r.next++
+	if r.next == len(r.items) {
+		r.next, r.full = 0, true
+	}
+}
+
+// list returns the items, oldest first
+func (r *ring[T]) list() []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]T(nil), r.items[:r.next]...)
+	}
+	items := make([]T, 0, len(r.items))
+	items = append(items, r.items[r.next:]...)
+	return append(items, r.items[:r.next]...)
+}
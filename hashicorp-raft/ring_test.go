@@ -0,0 +1,25 @@
+package raftpebble
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	r := newRing[int](3)
+	assert.Empty(t, r.list())
+	for i := 1; i <= 5; i++ {
+		r.add(i)
+		items := r.list()
+		want := i
+		if want > 3 {
+			want = 3
+		}
+		assert.Len(t, items, want)
+		// the recent ones, oldest first
+		for j, item := range items {
+			assert.Equal(t, i-want+1+j, item)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package raftpebble
+
+import (
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// defaultSlowOpHistory is the number of recent slow ops kept by default
+const defaultSlowOpHistory = 64
+
+// slow op names
+const (
+	SlowOpStoreLog  = "StoreLog"
+	SlowOpStoreLogs = "StoreLogs"
+	SlowOpSet       = "Set"
+	// pebble disk operation, reported by the DiskSlow event
+	SlowOpDisk = "DiskSlow"
+)
+
+// SlowOp is a store call or disk operation slower than the slow threshold
+type SlowOp struct {
+	Op       string
+	Start    time.Time
+	Duration time.Duration
+	// Entries and the index range of the StoreLog(s) batch
+	Entries    int
+	FirstIndex uint64
+	LastIndex  uint64
+	// Bytes of the logs data and extensions, the Set key and value,
+	// or the disk write size
+	Bytes int
+	// Path and DiskOp of the DiskSlow event, which may be still in progress
+	Path   string
+	DiskOp string
+}
+
+// slowOps is the ring of the recent slow ops
+type slowOps struct {
+	threshold time.Duration
+	*ring[SlowOp]
+}
+
+func newSlowOps(threshold time.Duration, history int) *slowOps {
+	if history <= 0 {
+		history = defaultSlowOpHistory
+	}
+	return &slowOps{
+		threshold: threshold,
+		ring:      newRing[SlowOp](history),
+	}
+}
+
+// SlowOps returns the recent slow ops, oldest first,
+// notice: nil if not enabled with WithSlowOpThreshold
+func (s *PebbleKVStore) SlowOps() []SlowOp {
+	if s.slowOps == nil {
+		return nil
+	}
+	return s.slowOps.list()
+}
+
+// observeLogs measures StoreLog(s), and records the call if slow
+func (s *PebbleKVStore) observeLogs(op string, start time.Time, logs ...*raft.Log) {
+	if s.slowOps == nil {
+		return
+	}
+	metrics.MeasureSince([]string{"raft", "pebble", op}, start)
+	d := time.Since(start)
+	if d < s.slowOps.threshold || len(logs) == 0 {
+		return
+	}
+
+	slow := SlowOp{
+		Op:         op,
+		Start:      start,
+		Duration:   d,
+		Entries:    len(logs),
+		FirstIndex: logs[0].Index,
+		LastIndex:  logs[len(logs)-1].Index,
+	}
+	for _, log := range logs {
+		slow.Bytes += len(log.Data) + len(log.Extensions)
+	}
+	s.recordSlow(slow)
+}
+
+// observeSet measures Set, and records the call if slow
+func (s *PebbleKVStore) observeSet(start time.Time, key, val []byte) {
+	if s.slowOps == nil {
+		return
+	}
+	metrics.MeasureSince([]string{"raft", "pebble", SlowOpSet}, start)
+	if d := time.Since(start); d >= s.slowOps.threshold {
+		s.recordSlow(SlowOp{
+			Op:       SlowOpSet,
+			Start:    start,
+			Duration: d,
+			Bytes:    len(key) + len(val),
+		})
+	}
+}
+
+func (s *PebbleKVStore) recordSlow(op SlowOp) {
+	metrics.IncrCounter([]string{"raft", "pebble", "slow", op.Op}, 1)
+	switch op.Op {
+	case SlowOpDisk:
+		s.logEvent(hclog.Warn, "slow disk operation", "op", op.DiskOp, "path", op.Path,
+			"bytes", op.Bytes, "duration", op.Duration)
+	case SlowOpSet:
+		s.logEvent(hclog.Warn, "slow Set", "duration", op.Duration, "bytes", op.Bytes)
+	default:
+		s.logEvent(hclog.Warn, "slow "+op.Op, "duration", op.Duration, "entries", op.Entries,
+			"firstIndex", op.FirstIndex, "lastIndex", op.LastIndex, "bytes", op.Bytes)
+	}
+	if s.slowOps != nil {
+		s.slowOps.add(op)
+	}
+}
+
+// onDiskSlow records the pebble disk operations slower than the slow threshold
+func (l *eventListener) onDiskSlow(info vfs.DiskSlowInfo) {
+	l.kv.recordSlow(SlowOp{
+		Op:       SlowOpDisk,
+		Start:    time.Now().Add(-info.Duration),
+		Duration: info.Duration,
+		Bytes:    info.WriteSize,
+		Path:     info.Path,
+		DiskOp:   info.OpType.String(),
+	})
+}
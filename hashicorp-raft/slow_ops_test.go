@@ -0,0 +1,98 @@
+package raftpebble
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPebbleKVStore_SlowOps(t *testing.T) {
+	// every call is slow
+	store, walDir, dir := testPebbleKVStore(t, WithSlowOpThreshold(time.Nanosecond, 0))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	// the real disk operations may be slower than 1ns too, skip them
+	slowOps := func() []SlowOp {
+		var ops []SlowOp
+		for _, op := range store.SlowOps() {
+			if op.Op != SlowOpDisk || op.Path == "000001.log" {
+				ops = append(ops, op)
+			}
+		}
+		return ops
+	}
+	assert.Empty(t, slowOps())
+	assert.NoError(t, store.StoreLog(&raft.Log{Index: 1, Data: []byte("data")}))
+	assert.NoError(t, store.StoreLogs([]*raft.Log{
+		{Index: 2, Data: []byte("data")},
+		{Index: 3, Data: []byte("data"), Extensions: []byte("ext")},
+	}))
+	assert.NoError(t, store.Set([]byte("key"), []byte("val")))
+
+	ops := slowOps()
+	assert.Len(t, ops, 3)
+	assert.Equal(t, SlowOpStoreLog, ops[0].Op)
+	assert.Equal(t, 1, ops[0].Entries)
+	assert.Equal(t, uint64(1), ops[0].FirstIndex)
+	assert.Equal(t, 4, ops[0].Bytes)
+	assert.Equal(t, SlowOpStoreLogs, ops[1].Op)
+	assert.Equal(t, 2, ops[1].Entries)
+	assert.Equal(t, uint64(2), ops[1].FirstIndex)
+	assert.Equal(t, uint64(3), ops[1].LastIndex)
+	assert.Equal(t, 11, ops[1].Bytes)
+	assert.Equal(t, SlowOpSet, ops[2].Op)
+	assert.Equal(t, 6, ops[2].Bytes)
+	for _, op := range ops {
+		assert.True(t, op.Duration > 0)
+		assert.False(t, op.Start.IsZero())
+	}
+
+	// pebble DiskSlow events are recorded through the event listener
+	store.event.onDiskSlow(vfs.DiskSlowInfo{
+		Path:      "000001.log",
+		OpType:    vfs.OpTypeSync,
+		Duration:  time.Second,
+		WriteSize: 8,
+	})
+	ops = slowOps()
+	assert.Len(t, ops, 4)
+	assert.Equal(t, SlowOpDisk, ops[3].Op)
+	assert.Equal(t, "000001.log", ops[3].Path)
+	assert.Equal(t, vfs.OpTypeSync.String(), ops[3].DiskOp)
+	assert.Equal(t, time.Second, ops[3].Duration)
+}
+
+func TestPebbleKVStore_SlowOpsThreshold(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithSlowOpThreshold(time.Hour, 0))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	assert.NoError(t, store.StoreLog(&raft.Log{Index: 1}))
+	assert.NoError(t, store.Set([]byte("key"), []byte("val")))
+	assert.Empty(t, store.SlowOps())
+
+	disabled, walDir2, dir2 := testPebbleKVStore(t)
+	defer func() {
+		disabled.Close()
+		os.RemoveAll(walDir2)
+		os.RemoveAll(dir2)
+	}()
+	assert.NoError(t, disabled.StoreLog(&raft.Log{Index: 1}))
+	assert.Nil(t, disabled.SlowOps())
+}
+
+func TestSlowOps_History(t *testing.T) {
+	assert.Len(t, newSlowOps(time.Millisecond, 0).items, defaultSlowOpHistory)
+	assert.Len(t, newSlowOps(time.Millisecond, 8).items, 8)
+}
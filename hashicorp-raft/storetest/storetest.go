@@ -0,0 +1,493 @@
+// Package storetest provides a raft.LogStore/raft.StableStore conformance test suite,
+// which can run against any store constructor, eg: raftpebble.PebbleKVStore and its wrappers.
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t testing.TB, dir string) storetest.Store {
+//			store, err := raftpebble.New(raftpebble.WithDbDirPath(dir))
+//			if err != nil {
+//				t.Fatalf("err: %s", err)
+//			}
+//			return store
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// Store is the store under test
+type Store interface {
+	raft.LogStore
+	raft.StableStore
+	Close() error
+}
+
+// NewStoreFunc opens the store on dir,
+// called again with the same dir after Close to test persistence.
+type NewStoreFunc func(t testing.TB, dir string) Store
+
+// Run runs the conformance suite as subtests,
+// if the store IsMonotonic, gaps must be rejected, else tolerated.
+func Run(t *testing.T, newStore NewStoreFunc) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, newStore NewStoreFunc)
+	}{
+		{"EmptyState", testEmptyState},
+		{"StoreLogs", testStoreLogs},
+		{"StoreLog", testStoreLog},
+		{"Gaps", testGaps},
+		{"DeleteRange", testDeleteRange},
+		{"DeleteRangeAll", testDeleteRangeAll},
+		{"LargeEntries", testLargeEntries},
+		{"StableStore", testStableStore},
+		{"ConcurrentReaders", testConcurrentReaders},
+		{"ReopenPersistence", testReopenPersistence},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore)
+		})
+	}
+}
+
+// openStore opens a store on a temp dir, closed on test cleanup
+func openStore(t *testing.T, newStore NewStoreFunc) (Store, string) {
+	dir := t.TempDir()
+	s := newStore(t, dir)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s, dir
+}
+
+func isMonotonic(s Store) bool {
+	m, ok := s.(raft.MonotonicLogStore)
+	return ok && m.IsMonotonic()
+}
+
+func makeLogs(first, last uint64) []*raft.Log {
+	logs := make([]*raft.Log, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		logs = append(logs, &raft.Log{
+			Index: i,
+			Term:  i/10 + 1,
+			Type:  raft.LogCommand,
+			Data:  []byte(fmt.Sprintf("log%d", i)),
+		})
+	}
+	return logs
+}
+
+func storeLogs(t testing.TB, s Store, logs []*raft.Log) {
+	t.Helper()
+	if err := s.StoreLogs(logs); err != nil {
+		t.Fatalf("StoreLogs [%d,%d] err: %s", logs[0].Index, logs[len(logs)-1].Index, err)
+	}
+}
+
+func checkIndexes(t testing.TB, s Store, first, last uint64) {
+	t.Helper()
+	idx, err := s.FirstIndex()
+	if err != nil {
+		t.Fatalf("FirstIndex err: %s", err)
+	}
+	if idx != first {
+		t.Fatalf("FirstIndex got %d want %d", idx, first)
+	}
+	idx, err = s.LastIndex()
+	if err != nil {
+		t.Fatalf("LastIndex err: %s", err)
+	}
+	if idx != last {
+		t.Fatalf("LastIndex got %d want %d", idx, last)
+	}
+}
+
+func checkLog(t testing.TB, s Store, want *raft.Log) {
+	t.Helper()
+	got := new(raft.Log)
+	if err := s.GetLog(want.Index, got); err != nil {
+		t.Fatalf("GetLog(%d) err: %s", want.Index, err)
+	}
+	if got.Index != want.Index || got.Term != want.Term || got.Type != want.Type ||
+		!bytes.Equal(got.Data, want.Data) || !bytes.Equal(got.Extensions, want.Extensions) ||
+		!got.AppendedAt.Equal(want.AppendedAt) {
+		t.Fatalf("GetLog(%d) got %+v want %+v", want.Index, got, want)
+	}
+}
+
+func checkNoLog(t testing.TB, s Store, index uint64) {
+	t.Helper()
+	if err := s.GetLog(index, new(raft.Log)); err != raft.ErrLogNotFound {
+		t.Fatalf("GetLog(%d) got err %v want %v", index, err, raft.ErrLogNotFound)
+	}
+}
+
+// isNotFound checks the not found error raft expects from StableStore
+func isNotFound(err error) bool {
+	return err != nil && err.Error() == "not found"
+}
+
+func testEmptyState(t *testing.T, newStore NewStoreFunc) {
+	s, _ := openStore(t, newStore)
+
+	checkIndexes(t, s, 0, 0)
+	checkNoLog(t, s, 0)
+	checkNoLog(t, s, 1)
+
+	if _, err := s.Get([]byte("CurrentTerm")); !isNotFound(err) {
+		t.Fatalf("Get missing key got err %v want not found", err)
+	}
+	if v, err := s.GetUint64([]byte("CurrentTerm")); !isNotFound(err) && (err != nil || v != 0) {
+		t.Fatalf("GetUint64 missing key got %d,%v want not found", v, err)
+	}
+
+	// stable keys are not logs
+	if err := s.SetUint64([]byte("CurrentTerm"), 1); err != nil {
+		t.Fatalf("SetUint64 err: %s", err)
+	}
+	checkIndexes(t, s, 0, 0)
+
+	// empty delete
+	if err := s.DeleteRange(1, 10); err != nil {
+		t.Fatalf("DeleteRange on empty log err: %s", err)
+	}
+	checkIndexes(t, s, 0, 0)
+}
+
+func testStoreLogs(t *testing.T, newStore NewStoreFunc) {
+	s, _ := openStore(t, newStore)
+
+	logs := makeLogs(1, 100)
+	logs[10].Type = raft.LogConfiguration
+	logs[20].Extensions = []byte("ext")
+	logs[30].Data = nil
+	storeLogs(t, s, logs[:50])
+	storeLogs(t, s, logs[50:])
+
+	checkIndexes(t, s, 1, 100)
+	for _, log := range logs {
+		checkLog(t, s, log)
+	}
+	checkNoLog(t, s, 0)
+	checkNoLog(t, s, 101)
+}
+
+func testStoreLog(t *testing.T, newStore NewStoreFunc) {
+	s, _ := openStore(t, newStore)
+
+	logs := makeLogs(5, 10)
+	for _, log := range logs {
+		if err := s.StoreLog(log); err != nil {
+			t.Fatalf("StoreLog(%d) err: %s", log.Index, err)
+		}
+	}
+
+	checkIndexes(t, s, 5, 10)
+	for _, log := range logs {
+		checkLog(t, s, log)
+	}
+}
+
+func testGaps(t *testing.T, newStore NewStoreFunc) {
+	s, _ := openStore(t, newStore)
+	storeLogs(t, s, makeLogs(1, 10))
+
+	gapBatch := []*raft.Log{makeLogs(11, 11)[0], makeLogs(13, 13)[0]}
+	gapAfterLast := makeLogs(20, 25)
+	if isMonotonic(s) {
+		if err := s.StoreLogs(gapBatch); err == nil {
+			t.Fatalf("monotonic store accepted non-contiguous batch")
+		}
+		if err := s.StoreLogs(gapAfterLast); err == nil {
+			t.Fatalf("monotonic store accepted gap after last index")
+		}
+		checkIndexes(t, s, 1, 10)
+		checkNoLog(t, s, 11)
+		return
+	}
+
+	storeLogs(t, s, gapBatch)
+	storeLogs(t, s, gapAfterLast)
+	checkIndexes(t, s, 1, 25)
+	checkLog(t, s, gapBatch[0])
+	checkLog(t, s, gapBatch[1])
+	for _, idx := range []uint64{12, 14, 19} {
+		checkNoLog(t, s, idx)
+	}
+}
+
+func testDeleteRange(t *testing.T, newStore NewStoreFunc) {
+	s, _ := openStore(t, newStore)
+	logs := makeLogs(1, 100)
+	storeLogs(t, s, logs)
+
+	// prefix
+	if err := s.DeleteRange(1, 10); err != nil {
+		t.Fatalf("DeleteRange err: %s", err)
+	}
+	checkIndexes(t, s, 11, 100)
+	checkNoLog(t, s, 10)
+	checkLog(t, s, logs[10])
+
+	// prefix starting before first
+	if err := s.DeleteRange(0, 20); err != nil {
+		t.Fatalf("DeleteRange err: %s", err)
+	}
+	checkIndexes(t, s, 21, 100)
+
+	// single log
+	if err := s.DeleteRange(21, 21); err != nil {
+		t.Fatalf("DeleteRange err: %s", err)
+	}
+	checkIndexes(t, s, 22, 100)
+
+	// suffix, like raft deleting conflicts
+	if err := s.DeleteRange(91, 100); err != nil {
+		t.Fatalf("DeleteRange err: %s", err)
+	}
+	checkIndexes(t, s, 22, 90)
+	checkNoLog(t, s, 91)
+
+	// suffix ending after last
+	if err := s.DeleteRange(81, 1000); err != nil {
+		t.Fatalf("DeleteRange err: %s", err)
+	}
+	checkIndexes(t, s, 22, 80)
+
+	// beyond last is a no-op
+	if err := s.DeleteRange(500, 600); err != nil {
+		t.Fatalf("DeleteRange err: %s", err)
+	}
+	checkIndexes(t, s, 22, 80)
+
+	// append after suffix truncation
+	storeLogs(t, s, makeLogs(81, 85))
+	checkIndexes(t, s, 22, 85)
+
+	// middle
+	err := s.DeleteRange(40, 50)
+	if isMonotonic(s) {
+		if err == nil {
+			t.Fatalf("monotonic store deleted from the middle")
+		}
+		checkLog(t, s, logs[44])
+		return
+	}
+	if err != nil {
+		t.Fatalf("DeleteRange err: %s", err)
+	}
+	checkIndexes(t, s, 22, 85)
+	checkNoLog(t, s, 45)
+	checkLog(t, s, logs[50])
+}
+
+func testDeleteRangeAll(t *testing.T, newStore NewStoreFunc) {
+	s, _ := openStore(t, newStore)
+	storeLogs(t, s, makeLogs(1, 100))
+
+	// raft deletes all logs after snapshot restore
+	if err := s.DeleteRange(1, 100); err != nil {
+		t.Fatalf("DeleteRange err: %s", err)
+	}
+	checkIndexes(t, s, 0, 0)
+	checkNoLog(t, s, 1)
+	checkNoLog(t, s, 100)
+
+	// the empty log can start after the snapshot index
+	logs := makeLogs(1000, 1010)
+	storeLogs(t, s, logs)
+	checkIndexes(t, s, 1000, 1010)
+	checkLog(t, s, logs[0])
+}
+
+func testLargeEntries(t *testing.T, newStore NewStoreFunc) {
+	s, _ := openStore(t, newStore)
+
+	logs := makeLogs(1, 4)
+	for i, log := range logs {
+		log.Data = bytes.Repeat([]byte{byte('a' + i)}, (1<<20)*(i+1))
+	}
+	storeLogs(t, s, logs[:2])
+	storeLogs(t, s, logs[2:])
+
+	checkIndexes(t, s, 1, 4)
+	for _, log := range logs {
+		checkLog(t, s, log)
+	}
+
+	big := bytes.Repeat([]byte("v"), 1<<20)
+	if err := s.Set([]byte("big"), big); err != nil {
+		t.Fatalf("Set err: %s", err)
+	}
+	val, err := s.Get([]byte("big"))
+	if err != nil {
+		t.Fatalf("Get err: %s", err)
+	}
+	if !bytes.Equal(val, big) {
+		t.Fatalf("Get got %d bytes want %d", len(val), len(big))
+	}
+}
+
+func testStableStore(t *testing.T, newStore NewStoreFunc) {
+	s, _ := openStore(t, newStore)
+
+	if err := s.Set([]byte("k"), []byte("v1")); err != nil {
+		t.Fatalf("Set err: %s", err)
+	}
+	if err := s.Set([]byte("k"), []byte("v2")); err != nil {
+		t.Fatalf("Set err: %s", err)
+	}
+	val, err := s.Get([]byte("k"))
+	if err != nil {
+		t.Fatalf("Get err: %s", err)
+	}
+	if string(val) != "v2" {
+		t.Fatalf("Get got %q want %q", val, "v2")
+	}
+
+	// keys with a common prefix are distinct
+	if _, err := s.Get([]byte("k2")); !isNotFound(err) {
+		t.Fatalf("Get missing key got err %v want not found", err)
+	}
+	if _, err := s.Get([]byte("")); !isNotFound(err) {
+		t.Fatalf("Get missing key got err %v want not found", err)
+	}
+
+	for _, v := range []uint64{0, 1, 1 << 32, ^uint64(0)} {
+		if err := s.SetUint64([]byte("u"), v); err != nil {
+			t.Fatalf("SetUint64 err: %s", err)
+		}
+		got, err := s.GetUint64([]byte("u"))
+		if err != nil {
+			t.Fatalf("GetUint64 err: %s", err)
+		}
+		if got != v {
+			t.Fatalf("GetUint64 got %d want %d", got, v)
+		}
+	}
+
+	// the stable store and logs don't interfere
+	storeLogs(t, s, makeLogs(1, 10))
+	if err := s.DeleteRange(1, 10); err != nil {
+		t.Fatalf("DeleteRange err: %s", err)
+	}
+	if _, err := s.Get([]byte("k")); err != nil {
+		t.Fatalf("Get after DeleteRange err: %s", err)
+	}
+}
+
+func testConcurrentReaders(t *testing.T, newStore NewStoreFunc) {
+	s, _ := openStore(t, newStore)
+	storeLogs(t, s, makeLogs(1, 100))
+
+	const readers = 8
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				first, err := s.FirstIndex()
+				if err != nil {
+					errs <- err
+					return
+				}
+				last, err := s.LastIndex()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if first == 0 || last < first {
+					continue
+				}
+				// logs may be truncated between the index reads and GetLog
+				idx := first + uint64(i+r)%(last-first+1)
+				log := new(raft.Log)
+				err = s.GetLog(idx, log)
+				if err == raft.ErrLogNotFound {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				if want := fmt.Sprintf("log%d", idx); log.Index != idx || string(log.Data) != want {
+					errs <- fmt.Errorf("GetLog(%d) got %d %q", idx, log.Index, log.Data)
+					return
+				}
+			}
+		}(r)
+	}
+
+	// writer appends and truncates the prefix like raft
+	for i := uint64(1); i <= 50; i++ {
+		storeLogs(t, s, makeLogs(100+i*10-9, 100+i*10))
+		if err := s.DeleteRange(i*10-9, i*10); err != nil {
+			t.Fatalf("DeleteRange err: %s", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("reader err: %s", err)
+	}
+	checkIndexes(t, s, 501, 600)
+}
+
+func testReopenPersistence(t *testing.T, newStore NewStoreFunc) {
+	dir := t.TempDir()
+	s := newStore(t, dir)
+
+	logs := makeLogs(1, 100)
+	storeLogs(t, s, logs)
+	if err := s.DeleteRange(1, 20); err != nil {
+		t.Fatalf("DeleteRange err: %s", err)
+	}
+	if err := s.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Set err: %s", err)
+	}
+	if err := s.SetUint64([]byte("CurrentTerm"), 7); err != nil {
+		t.Fatalf("SetUint64 err: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close err: %s", err)
+	}
+
+	s = newStore(t, dir)
+	defer s.Close()
+
+	checkIndexes(t, s, 21, 100)
+	checkNoLog(t, s, 20)
+	for _, log := range logs[20:] {
+		checkLog(t, s, log)
+	}
+	val, err := s.Get([]byte("k"))
+	if err != nil || string(val) != "v" {
+		t.Fatalf("Get got %q,%v want %q", val, err, "v")
+	}
+	term, err := s.GetUint64([]byte("CurrentTerm"))
+	if err != nil || term != 7 {
+		t.Fatalf("GetUint64 got %d,%v want %d", term, err, 7)
+	}
+
+	// keeps appending after reopen
+	storeLogs(t, s, makeLogs(101, 110))
+	checkIndexes(t, s, 21, 110)
+}
@@ -0,0 +1,87 @@
+package raftpebble
+
+import (
+	"context"
+
+	"github.com/hashicorp/raft"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the store spans
+const tracerName = "github.com/weedge/raft-pebble"
+
+// span names
+const (
+	spanStoreLog    = "raft-pebble.StoreLog"
+	spanStoreLogs   = "raft-pebble.StoreLogs"
+	spanGetLog      = "raft-pebble.GetLog"
+	spanDeleteRange = "raft-pebble.DeleteRange"
+	spanSet         = "raft-pebble.Set"
+	spanGet         = "raft-pebble.Get"
+)
+
+// span attribute keys
+const (
+	attrIndex      = attribute.Key("raft.index")
+	attrFirstIndex = attribute.Key("raft.first_index")
+	attrLastIndex  = attribute.Key("raft.last_index")
+	attrEntries    = attribute.Key("raft.entries")
+	attrBytes      = attribute.Key("raft.bytes")
+	attrKey        = attribute.Key("raft.key")
+	attrFound      = attribute.Key("raft.found")
+)
+
+// startSpan starts a root span, as the raft store interfaces carry no context,
+// the callers check s.tracer first, so no attrs are built if not enabled.
+func (s *PebbleKVStore) startSpan(name string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := s.tracer.Start(context.Background(), name,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attrs...))
+	return span
+}
+
+// endSpan ends the span with the error status, not found isn't an error
+func endSpan(span trace.Span, err *error) {
+	switch *err {
+	case nil:
+	case raft.ErrLogNotFound, ErrKeyNotFound:
+		span.SetAttributes(attrFound.Bool(false))
+	default:
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// logsAttrs returns the index range, entries and data bytes of the logs
+func logsAttrs(logs []*raft.Log) []attribute.KeyValue {
+	var first, last uint64
+	bytes := 0
+	if len(logs) > 0 {
+		first, last = logs[0].Index, logs[len(logs)-1].Index
+	}
+	for _, log := range logs {
+		bytes += len(log.Data) + len(log.Extensions)
+	}
+	return []attribute.KeyValue{
+		attrFirstIndex.Int64(int64(first)),
+		attrLastIndex.Int64(int64(last)),
+		attrEntries.Int(len(logs)),
+		attrBytes.Int(bytes),
+	}
+}
+
+// deleteRangeAttrs returns the index range and entries of [min,max],
+// no entries if min > max, which is rejected
+func deleteRangeAttrs(min, max uint64) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attrFirstIndex.Int64(int64(min)),
+		attrLastIndex.Int64(int64(max)),
+	}
+	if min <= max {
+		attrs = append(attrs, attrEntries.Int64(int64(max-min+1)))
+	}
+	return attrs
+}
@@ -0,0 +1,98 @@
+package raftpebble
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttrs(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestPebbleKVStore_Tracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	store, walDir, dir := testPebbleKVStore(t, WithTracerProvider(tp))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	assert.NoError(t, store.StoreLog(&raft.Log{Index: 1, Data: []byte("data")}))
+	assert.NoError(t, store.StoreLogs([]*raft.Log{
+		{Index: 2, Data: []byte("data")},
+		{Index: 3, Data: []byte("data"), Extensions: []byte("ext")},
+	}))
+	assert.NoError(t, store.GetLog(2, new(raft.Log)))
+	assert.Equal(t, raft.ErrLogNotFound, store.GetLog(9, new(raft.Log)))
+	assert.NoError(t, store.DeleteRange(1, 2))
+	assert.NoError(t, store.Set([]byte("key"), []byte("val")))
+	_, err := store.Get([]byte("key"))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, store.StoreLog(&raft.Log{Index: 9}), ErrNonMonotonicLogs)
+	assert.ErrorIs(t, store.DeleteRange(3, 1), ErrInvalidDeleteRange)
+
+	spans := exp.GetSpans()
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+		assert.False(t, span.Parent.IsValid())
+	}
+	assert.Equal(t, []string{
+		spanStoreLog, spanStoreLogs, spanGetLog, spanGetLog,
+		spanDeleteRange, spanSet, spanGet, spanStoreLog, spanDeleteRange,
+	}, names)
+
+	attrs := spanAttrs(spans[0])
+	assert.Equal(t, int64(1), attrs[attrFirstIndex].AsInt64())
+	assert.Equal(t, int64(1), attrs[attrEntries].AsInt64())
+	assert.Equal(t, int64(4), attrs[attrBytes].AsInt64())
+
+	attrs = spanAttrs(spans[1])
+	assert.Equal(t, int64(2), attrs[attrFirstIndex].AsInt64())
+	assert.Equal(t, int64(3), attrs[attrLastIndex].AsInt64())
+	assert.Equal(t, int64(2), attrs[attrEntries].AsInt64())
+	assert.Equal(t, int64(11), attrs[attrBytes].AsInt64())
+
+	attrs = spanAttrs(spans[2])
+	assert.Equal(t, int64(2), attrs[attrIndex].AsInt64())
+	assert.True(t, attrs[attrBytes].AsInt64() > 0)
+	// not found isn't an error
+	attrs = spanAttrs(spans[3])
+	assert.False(t, attrs[attrFound].AsBool())
+	assert.Equal(t, codes.Unset, spans[3].Status.Code)
+
+	attrs = spanAttrs(spans[4])
+	assert.Equal(t, int64(1), attrs[attrFirstIndex].AsInt64())
+	assert.Equal(t, int64(2), attrs[attrLastIndex].AsInt64())
+	assert.Equal(t, int64(2), attrs[attrEntries].AsInt64())
+
+	attrs = spanAttrs(spans[5])
+	assert.Equal(t, "key", attrs[attrKey].AsString())
+	assert.Equal(t, int64(3), attrs[attrBytes].AsInt64())
+	attrs = spanAttrs(spans[6])
+	assert.Equal(t, "key", attrs[attrKey].AsString())
+	assert.Equal(t, int64(3), attrs[attrBytes].AsInt64())
+
+	assert.Equal(t, codes.Error, spans[7].Status.Code)
+	assert.Len(t, spans[7].Events, 1)
+
+	// no entries for an inverted range
+	attrs = spanAttrs(spans[8])
+	assert.Equal(t, int64(3), attrs[attrFirstIndex].AsInt64())
+	_, ok := attrs[attrEntries]
+	assert.False(t, ok)
+	assert.Equal(t, codes.Error, spans[8].Status.Code)
+}
@@ -0,0 +1,326 @@
+package raftpebble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+)
+
+// ErrTxnDone is an error indicating the txn is already committed or discarded
+var ErrTxnDone = errors.New("txn is committed or discarded")
+
+// Txn stages log appends, truncations and stable key updates,
+// which are committed atomically in one pebble batch with a single sync,
+// eg: persist entries with a term/vote change.
+// the ops are checked against the log state after the former staged ops,
+// a failed op fails the txn, Commit returns its error.
+// notice: a Txn is not safe for concurrent use, and the store must not be
+// written by others before Commit, like raft single writer.
+type Txn struct {
+	s   *PebbleKVStore
+	wb  *pebble.Batch
+	e   *msgpackEncoder
+	key []byte
+	err error
+
+	// log bounds after the staged ops, loaded on the first log op if monotonic
+	loaded      bool
+	empty       bool
+	first, last uint64
+
+	// staged logs with encoded sizes for LogStats, and deleted index span
+	appended bool
+	logs     []*raft.Log
+	deleted  bool
+	delMin   uint64
+	delMax   uint64
+}
+
+// NewTxn returns a Txn, which must be committed or discarded
+func (s *PebbleKVStore) NewTxn() *Txn {
+	t := &Txn{
+		s: s,
+		e: getEncoder(),
+	}
+	if s.stats != nil {
+		// the truncated summaries are rebuilt by reading through the batch
+		t.wb = s.db.NewIndexedBatch()
+	} else {
+		t.wb = s.db.NewBatch()
+	}
+	return t
+}
+
+// StoreLog stages a single raft log
+func (t *Txn) StoreLog(log *raft.Log) error {
+	return t.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs stages a set of raft logs
+func (t *Txn) StoreLogs(logs []*raft.Log) (err error) {
+	if err = t.check(); err != nil || len(logs) == 0 {
+		return
+	}
+	defer t.fail(&err)
+
+	if err = t.checkAppend(logs); err != nil {
+		return
+	}
+	t.appended = true
+	for _, log := range logs {
+		key := logKey(log.Index)
+		val, err := t.e.encode(log)
+		if err != nil {
+			return err
+		}
+		if err = t.wb.Set(key[:], val, nil); err != nil {
+			return err
+		}
+		if t.s.stats != nil {
+			t.logs = append(t.logs, log)
+			t.e.sizes = append(t.e.sizes, uint64(len(key)+len(val)))
+		}
+	}
+
+	return
+}
+
+// DeleteRange stages deleting logs within a given range inclusively
+// notice: if monotonic, only prefix or suffix truncation allowed
+func (t *Txn) DeleteRange(min, max uint64) (err error) {
+	if err = t.check(); err != nil {
+		return
+	}
+	defer t.fail(&err)
+
+	if err = t.checkDeleteRange(min, max); err != nil {
+		return
+	}
+	fk, lk := logKey(min), logKey(max+1)
+	if err = t.wb.DeleteRange(fk[:], lk[:], nil); err != nil {
+		return
+	}
+	if !t.deleted || min < t.delMin {
+		t.delMin = min
+	}
+	if !t.deleted || max > t.delMax {
+		t.delMax = max
+	}
+	t.deleted = true
+
+	return
+}
+
+// Set stages a stable key/value
+func (t *Txn) Set(key []byte, val []byte) (err error) {
+	if err = t.check(); err != nil {
+		return
+	}
+	defer t.fail(&err)
+
+	// the batch copies the key
+	t.key = encodeStableKey(t.key[:0], key)
+	return t.wb.Set(t.key, val, nil)
+}
+
+// SetUint64 is like Set, but handles uint64 values
+func (t *Txn) SetUint64(key []byte, val uint64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], val)
+	return t.Set(key, b[:])
+}
+
+// Commit commits the staged ops atomically, the txn is done after it
+func (t *Txn) Commit() (err error) {
+	if err = t.check(); err != nil {
+		return
+	}
+	s := t.s
+	defer t.Discard()
+	if err = s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	defer s.recoverFatal(&err)
+
+	if err = s.failure(); err != nil {
+		return
+	}
+	if t.wb.Empty() {
+		return
+	}
+
+	if t.appended {
+		if err = s.checkDiskSpace(); err != nil {
+			return
+		}
+	}
+	if s.quota != nil && t.appended {
+		if err = s.reserveQuota(uint64(t.wb.Len())); err != nil {
+			return
+		}
+	}
+	var last uint64
+	if t.deleted && s.compactor != nil {
+		if last, err = s.LastIndex(); err != nil {
+			return
+		}
+	}
+	if s.stats == nil {
+		err = s.db.Apply(t.wb, s.defaultWriteOpts)
+	} else {
+		err = t.applyLogStats()
+	}
+	if err != nil {
+		return
+	}
+	if t.deleted && s.compactor != nil {
+		// no logs after the last index to reclaim
+		if t.delMax < last {
+			last = t.delMax
+		}
+		s.compactor.add(t.delMin, last)
+	}
+	if t.deleted && s.quota != nil {
+		s.refreshQuota()
+	}
+
+	return
+}
+
+// applyLogStats applies the batch with the summaries of the touched ranges
+func (t *Txn) applyLogStats() error {
+	s := t.s
+	s.stats.writeMu.Lock()
+	defer s.stats.writeMu.Unlock()
+
+	u := make(logStatsUpdate)
+	if !t.deleted {
+		for i, log := range t.logs {
+			s.stats.stage(u, log, t.e.sizes[i])
+		}
+		return s.applyLogStats(t.wb, u)
+	}
+
+	// the staged logs may be deleted after, so rebuild the touched ranges
+	min, max := t.delMin, t.delMax
+	for _, log := range t.logs {
+		if log.Index < min {
+			min = log.Index
+		}
+		if log.Index > max {
+			max = log.Index
+		}
+	}
+	if err := s.rebuildLogStats(t.wb, min, max, u); err != nil {
+		return err
+	}
+	return s.applyLogStats(t.wb, u)
+}
+
+// Discard drops the staged ops, which is a no-op after Commit
+func (t *Txn) Discard() {
+	if t.wb == nil {
+		return
+	}
+	t.wb.Close()
+	putEncoder(t.e)
+	t.wb, t.e, t.logs = nil, nil, nil
+	if t.err == nil {
+		t.err = ErrTxnDone
+	}
+}
+
+func (t *Txn) check() error {
+	if t.wb == nil {
+		return ErrTxnDone
+	}
+	return t.err
+}
+
+// fail fails the txn with err, as the batch may be partially staged
+func (t *Txn) fail(err *error) {
+	if *err != nil {
+		t.err = *err
+	}
+}
+
+// loadBounds loads the log bounds from the store on the first log op
+func (t *Txn) loadBounds() (err error) {
+	if t.loaded {
+		return
+	}
+	if err = t.s.acquire(); err != nil {
+		return
+	}
+	defer t.s.release()
+	if t.empty = t.s.isEmptyLog(); !t.empty {
+		if t.first, err = t.s.FirstIndex(); err != nil {
+			return
+		}
+		if t.last, err = t.s.LastIndex(); err != nil {
+			return
+		}
+	}
+	t.loaded = true
+
+	return
+}
+
+// checkAppend checks the logs like StoreLogs, and moves the bounds
+func (t *Txn) checkAppend(logs []*raft.Log) error {
+	if !t.s.options.monotonic {
+		return nil
+	}
+	if err := checkContiguous(logs); err != nil {
+		return err
+	}
+	if err := t.loadBounds(); err != nil {
+		return err
+	}
+	if t.empty {
+		t.first, t.empty = logs[0].Index, false
+	} else if err := checkFollows(logs, t.last); err != nil {
+		return err
+	}
+	t.last = logs[len(logs)-1].Index
+
+	return nil
+}
+
+// checkDeleteRange checks [min,max] like DeleteRange, and moves the bounds
+func (t *Txn) checkDeleteRange(min, max uint64) error {
+	if !t.s.options.monotonic {
+		return nil
+	}
+	if min > max {
+		return fmt.Errorf("%w: min %d > max %d", ErrInvalidDeleteRange, min, max)
+	}
+	if err := t.loadBounds(); err != nil {
+		return err
+	}
+	if t.empty {
+		return nil
+	}
+	if err := checkDeleteBounds(min, max, t.first, t.last); err != nil {
+		return err
+	}
+
+	switch {
+	case min <= t.first && max >= t.last:
+		t.empty, t.first, t.last = true, 0, 0
+	case min <= t.first:
+		if max >= t.first {
+			t.first = max + 1
+		}
+	default:
+		if min <= t.last {
+			t.last = min - 1
+		}
+	}
+
+	return nil
+}
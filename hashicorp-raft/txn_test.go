@@ -0,0 +1,166 @@
+package raftpebble
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func txnLogs(first, last, term uint64) []*raft.Log {
+	var logs []*raft.Log
+	for i := first; i <= last; i++ {
+		logs = append(logs, &raft.Log{
+			Index:      i,
+			Term:       term,
+			Data:       []byte("data"),
+			AppendedAt: time.Now(),
+		})
+	}
+	return logs
+}
+
+func TestPebbleKVStore_Txn(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	txn := store.NewTxn()
+	assert.Nil(t, txn.StoreLogs(txnLogs(1, 10, 1)))
+	assert.Nil(t, txn.SetUint64([]byte("CurrentTerm"), 1))
+	assert.Nil(t, txn.Set([]byte("LastVoteCand"), []byte("node1")))
+
+	// nothing visible before commit
+	last, err := store.LastIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), last)
+	_, err = store.GetUint64([]byte("CurrentTerm"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, txn.Commit())
+	last, err = store.LastIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), last)
+	term, err := store.GetUint64([]byte("CurrentTerm"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), term)
+	cand, err := store.Get([]byte("LastVoteCand"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("node1"), cand)
+
+	// done after commit
+	assert.Equal(t, ErrTxnDone, txn.Commit())
+	assert.Equal(t, ErrTxnDone, txn.StoreLog(txnLogs(11, 11, 1)[0]))
+	txn.Discard()
+
+	// a new leader overwrites the conflicting suffix with a new term
+	txn = store.NewTxn()
+	assert.Nil(t, txn.DeleteRange(6, 10))
+	assert.Nil(t, txn.StoreLogs(txnLogs(6, 8, 2)))
+	assert.Nil(t, txn.SetUint64([]byte("CurrentTerm"), 2))
+	assert.Nil(t, txn.Commit())
+
+	last, err = store.LastIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8), last)
+	log := new(raft.Log)
+	assert.Nil(t, store.GetLog(6, log))
+	assert.Equal(t, uint64(2), log.Term)
+	assert.Nil(t, store.GetLog(5, log))
+	assert.Equal(t, uint64(1), log.Term)
+}
+
+func TestPebbleKVStore_Txn_Discard(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	txn := store.NewTxn()
+	assert.Nil(t, txn.StoreLogs(txnLogs(1, 3, 1)))
+	assert.Nil(t, txn.SetUint64([]byte("CurrentTerm"), 1))
+	txn.Discard()
+	assert.Equal(t, ErrTxnDone, txn.Commit())
+
+	assert.True(t, store.isEmptyLog())
+	_, err := store.GetUint64([]byte("CurrentTerm"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestPebbleKVStore_Txn_Monotonic(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	assert.Nil(t, store.StoreLogs(txnLogs(1, 10, 1)))
+
+	// checked against the staged state, not the stored one
+	txn := store.NewTxn()
+	assert.Nil(t, txn.StoreLogs(txnLogs(11, 12, 1)))
+	assert.Nil(t, txn.StoreLogs(txnLogs(13, 13, 1)))
+	assert.Nil(t, txn.DeleteRange(1, 5))
+	err := txn.DeleteRange(7, 8)
+	assert.True(t, errors.Is(err, ErrInvalidDeleteRange), "err %v", err)
+	// a failed op fails the txn
+	assert.True(t, errors.Is(txn.SetUint64([]byte("CurrentTerm"), 1), ErrInvalidDeleteRange))
+	assert.True(t, errors.Is(txn.Commit(), ErrInvalidDeleteRange))
+
+	last, err := store.LastIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), last)
+
+	txn = store.NewTxn()
+	err = txn.StoreLogs(txnLogs(12, 12, 1))
+	assert.True(t, errors.Is(err, ErrNonMonotonicLogs), "err %v", err)
+	txn.Discard()
+
+	// all deleted, then any index starts the log
+	txn = store.NewTxn()
+	assert.Nil(t, txn.DeleteRange(0, 10))
+	assert.Nil(t, txn.StoreLogs(txnLogs(100, 101, 2)))
+	assert.Nil(t, txn.Commit())
+	first, err := store.FirstIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), first)
+}
+
+func TestPebbleKVStore_Txn_LogStats(t *testing.T) {
+	store, walDir, dir := testPebbleKVStore(t, WithLogStats(0))
+	defer func() {
+		store.Close()
+		os.RemoveAll(walDir)
+		os.RemoveAll(dir)
+	}()
+
+	txn := store.NewTxn()
+	assert.Nil(t, txn.StoreLogs(txnLogs(1, 3000, 1)))
+	assert.Nil(t, txn.Commit())
+	st := store.LogStats()
+	assert.EqualValues(t, 3000, st.Entries)
+
+	txn = store.NewTxn()
+	assert.Nil(t, txn.DeleteRange(2000, 3000))
+	assert.Nil(t, txn.StoreLogs(txnLogs(2000, 2500, 2)))
+	assert.Nil(t, txn.DeleteRange(1, 1500))
+	assert.Nil(t, txn.Commit())
+
+	st = store.LogStats()
+	assert.EqualValues(t, 1501, st.FirstIndex)
+	assert.EqualValues(t, 2500, st.LastIndex)
+	assert.EqualValues(t, 1000, st.Entries)
+
+	// the same as rebuilt from the db
+	store = reopenTestPebbleKVStore(t, store, WithLogStats(0))
+	assert.Equal(t, st, store.LogStats())
+}
@@ -3,27 +3,120 @@ package raftpebble
 import (
 	"bytes"
 	"encoding/binary"
+	"sync"
 
 	"github.com/hashicorp/go-msgpack/codec"
 )
 
+// msgpackHandle is pre-configured, which is safe for concurrent use
+var msgpackHandle = &codec.MsgpackHandle{}
+
+// msgpackEncoder is a reusable encoder writing to its buffer,
+// the encoder caches type encode funcs, so pooled with the buffer.
+type msgpackEncoder struct {
+	buf bytes.Buffer
+	enc *codec.Encoder
+	// sizes is the StoreLogs batch arena of encoded log sizes
+	sizes []uint64
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		e := &msgpackEncoder{}
+		e.enc = codec.NewEncoder(&e.buf, msgpackHandle)
+		return e
+	},
+}
+
+// maxPooledBufSize drops buffers grown by large logs instead of pooling them
+const maxPooledBufSize = 1 << 20
+
+func getEncoder() *msgpackEncoder {
+	return encoderPool.Get().(*msgpackEncoder)
+}
+
+func putEncoder(e *msgpackEncoder) {
+	if e.buf.Cap() > maxPooledBufSize {
+		return
+	}
+	e.buf.Reset()
+	e.sizes = e.sizes[:0]
+	encoderPool.Put(e)
+}
+
+// encode resets the buffer and encodes in to it,
+// the returned bytes are valid until next encode or putEncoder.
+func (e *msgpackEncoder) encode(in interface{}) ([]byte, error) {
+	e.buf.Reset()
+	if err := e.enc.Encode(in); err != nil {
+		// renew the encoder, which may hold a half written state
+		e.enc = codec.NewEncoder(&e.buf, msgpackHandle)
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+// msgpackDecoder is a reusable decoder reading from its reader
+type msgpackDecoder struct {
+	r   bytes.Reader
+	dec *codec.Decoder
+}
+
+var decoderPool = sync.Pool{
+	New: func() interface{} {
+		d := &msgpackDecoder{}
+		d.dec = codec.NewDecoder(&d.r, msgpackHandle)
+		return d
+	},
+}
+
 // Decode reverses the encode operation on a byte slice input
 func decodeMsgPack(buf []byte, out interface{}) error {
-	r := bytes.NewBuffer(buf)
-	hd := codec.MsgpackHandle{}
-	dec := codec.NewDecoder(r, &hd)
-	return dec.Decode(out)
+	d := decoderPool.Get().(*msgpackDecoder)
+	d.r.Reset(buf)
+	err := d.dec.Decode(out)
+	if err != nil {
+		// the decoder may hold a half read state, drop it
+		return err
+	}
+	// not retain buf in the pool
+	d.r.Reset(nil)
+	decoderPool.Put(d)
+	return nil
 }
 
 // Encode writes an encoded object to a new bytes buffer
 func encodeMsgPack(in interface{}) (*bytes.Buffer, error) {
 	buf := bytes.NewBuffer(nil)
-	hd := codec.MsgpackHandle{}
-	enc := codec.NewEncoder(buf, &hd)
+	enc := codec.NewEncoder(buf, msgpackHandle)
 	err := enc.Encode(in)
 	return buf, err
 }
 
+// keyBuf is a pooled key buffer for the reads, which key escapes to heap
+type keyBuf struct {
+	b []byte
+}
+
+var keyBufPool = sync.Pool{
+	New: func() interface{} {
+		return &keyBuf{b: make([]byte, 0, 64)}
+	},
+}
+
+func getKeyBuf() *keyBuf {
+	return keyBufPool.Get().(*keyBuf)
+}
+
+// putKeyBuf puts back kb with the key built on it, which may be grown
+func putKeyBuf(kb *keyBuf, key []byte) {
+	if cap(key) > maxPooledBufSize {
+		return
+	}
+	kb.b = key[:0]
+	keyBufPool.Put(kb)
+}
+
 // Converts bytes to an integer
 func bytesToUint64(b []byte) uint64 {
 	return binary.BigEndian.Uint64(b)
@@ -0,0 +1,666 @@
+package raftpebble
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	defaultWALLatencyThreshold = time.Second
+	// probe the primary WAL dir every walProbeInterval while on the secondary,
+	// switch back after walFailbackProbes consecutive healthy probes
+	walProbeInterval  = time.Second
+	walFailbackProbes = 3
+	walProbeFile      = "wal-probe.tmp"
+	walProbeSize      = 4 << 10
+	// pebble WAL file name suffix, eg: 000123.log
+	walFileSuffix = ".log"
+)
+
+// ErrOrphanWAL is an error indicating the WAL failover secondary dir has WAL files
+// of a store without MANIFEST, eg: destroyed without the WithWALFailover option,
+// which pebble can't replay into a new store, remove them or use Destroy.
+var ErrOrphanWAL = errors.New("orphan WAL files in the secondary dir")
+
+// WALFailoverInfo is the WAL dir switch event
+type WALFailoverInfo struct {
+	// Secondary is true on failover, false on failback to the primary
+	Secondary bool
+	// Dir is the dir the new WAL files are created in
+	Dir string
+	// Path is the primary WAL file of the slow operation on failover
+	Path string
+	// Latency is the slow operation latency on failover,
+	// which may be still in progress, the last probe latency on failback
+	Latency time.Duration
+}
+
+// walFailoverFS presents the primary WAL dir as the union of the primary and
+// secondary dirs, the WAL files are created in the primary dir until a primary
+// WAL write or sync is slower than threshold, which moves the file to the
+// secondary dir, then in the secondary dir until the primary is healthy again,
+// so pebble recovers the WAL files of both dirs.
+type walFailoverFS struct {
+	vfs.FS
+	primary   string
+	secondary string
+	threshold time.Duration
+	// called with the slow primary WAL operation, maybe in progress
+	onSlow func(path string, latency time.Duration)
+
+	// 1 if the WAL files are created in the secondary dir
+	useSecondary int32
+
+	mu sync.Mutex
+	// open primary WAL files, checked for the stalled operations
+	files map[*walFile]struct{}
+}
+
+func newWALFailoverFS(fs vfs.FS, primary, secondary string, threshold time.Duration) *walFailoverFS {
+	return &walFailoverFS{
+		FS:        fs,
+		primary:   filepath.Clean(primary),
+		secondary: filepath.Clean(secondary),
+		threshold: threshold,
+		files:     make(map[*walFile]struct{}),
+	}
+}
+
+// onSecondary returns true if the WAL files are created in the secondary dir
+func (fs *walFailoverFS) onSecondary() bool {
+	return atomic.LoadInt32(&fs.useSecondary) == 1
+}
+
+// switchTo returns false if already on the dir
+func (fs *walFailoverFS) switchTo(secondary bool) bool {
+	if secondary {
+		return atomic.CompareAndSwapInt32(&fs.useSecondary, 0, 1)
+	}
+	return atomic.CompareAndSwapInt32(&fs.useSecondary, 1, 0)
+}
+
+func (fs *walFailoverFS) activeDir() string {
+	if fs.onSecondary() {
+		return fs.secondary
+	}
+	return fs.primary
+}
+
+// isWAL returns true for the WAL file names in the primary dir, as pebble names them
+func (fs *walFailoverFS) isWAL(name string) bool {
+	return strings.HasSuffix(name, walFileSuffix) && fs.PathDir(name) == fs.primary
+}
+
+// resolve returns the name of the WAL file in the dir it is in, the primary if none,
+// a moved WAL file is in both dirs until the stalled op returns, the secondary
+// copy is complete.
+func (fs *walFailoverFS) resolve(name string) string {
+	if !fs.isWAL(name) {
+		return name
+	}
+	alt := fs.PathJoin(fs.secondary, fs.PathBase(name))
+	if _, err := fs.FS.Stat(alt); err == nil {
+		return alt
+	}
+	return name
+}
+
+// target returns the name of a new WAL file in the active dir
+func (fs *walFailoverFS) target(name string) string {
+	if !fs.isWAL(name) {
+		return name
+	}
+	return fs.PathJoin(fs.activeDir(), fs.PathBase(name))
+}
+
+// track wraps the primary WAL files to time their ops
+func (fs *walFailoverFS) track(name string, f vfs.File) vfs.File {
+	if fs.PathDir(name) != fs.primary || !strings.HasSuffix(name, walFileSuffix) {
+		return f
+	}
+	wf := newWALFile(fs, name, f)
+	fs.mu.Lock()
+	fs.files[wf] = struct{}{}
+	fs.mu.Unlock()
+	return wf
+}
+
+func (fs *walFailoverFS) Create(name string) (vfs.File, error) {
+	name = fs.target(name)
+	f, err := fs.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.track(name, f), nil
+}
+
+func (fs *walFailoverFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	return fs.FS.Open(fs.resolve(name), opts...)
+}
+
+func (fs *walFailoverFS) Remove(name string) error {
+	return fs.FS.Remove(fs.resolve(name))
+}
+
+func (fs *walFailoverFS) Stat(name string) (os.FileInfo, error) {
+	return fs.FS.Stat(fs.resolve(name))
+}
+
+// Rename renames a WAL file in the dir it is in
+func (fs *walFailoverFS) Rename(oldname, newname string) error {
+	if fs.isWAL(oldname) && fs.isWAL(newname) {
+		oldname = fs.resolve(oldname)
+		newname = fs.PathJoin(fs.PathDir(oldname), fs.PathBase(newname))
+	}
+	return fs.FS.Rename(oldname, newname)
+}
+
+// ReuseForWrite recycles a WAL file in the active dir,
+// one in the other dir is removed and a new one created instead.
+func (fs *walFailoverFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	oldname, newname = fs.resolve(oldname), fs.target(newname)
+	var f vfs.File
+	var err error
+	if fs.PathDir(oldname) == fs.PathDir(newname) {
+		f, err = fs.FS.ReuseForWrite(oldname, newname)
+	} else if err = fs.FS.Remove(oldname); err == nil {
+		f, err = fs.FS.Create(newname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fs.track(newname, f), nil
+}
+
+// List lists the WAL files of the secondary dir in the primary dir
+func (fs *walFailoverFS) List(dir string) ([]string, error) {
+	ls, err := fs.FS.List(dir)
+	if err != nil || filepath.Clean(dir) != fs.primary {
+		return ls, err
+	}
+	ls2, err := fs.FS.List(fs.secondary)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(ls))
+	for _, name := range ls {
+		seen[name] = struct{}{}
+	}
+	for _, name := range ls2 {
+		if _, ok := seen[name]; !ok && strings.HasSuffix(name, walFileSuffix) {
+			ls = append(ls, name)
+		}
+	}
+	return ls, nil
+}
+
+// OpenDir opens both dirs for the primary dir, so pebble syncs the new WAL file entries
+func (fs *walFailoverFS) OpenDir(name string) (vfs.File, error) {
+	f, err := fs.FS.OpenDir(name)
+	if err != nil || filepath.Clean(name) != fs.primary {
+		return f, err
+	}
+	sf, err := fs.FS.OpenDir(fs.secondary)
+	if err != nil {
+		return nil, FirstError(err, f.Close())
+	}
+	return &walDir{File: f, secondary: sf}, nil
+}
+
+// checkOrphans returns ErrOrphanWAL if the secondary dir has WAL files,
+// but the db dir has no MANIFEST, a new store
+func (fs *walFailoverFS) checkOrphans(dir string) error {
+	ls, err := fs.FS.List(fs.secondary)
+	if err != nil {
+		return err
+	}
+	var wal string
+	for _, name := range ls {
+		if strings.HasSuffix(name, walFileSuffix) {
+			wal = name
+			break
+		}
+	}
+	if wal == "" {
+		return nil
+	}
+	ls, err = fs.FS.List(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, name := range ls {
+		if strings.HasPrefix(name, "MANIFEST-") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s in %s", ErrOrphanWAL, wal, fs.secondary)
+}
+
+// checkStalled reports the primary WAL operations in progress longer than threshold
+func (fs *walFailoverFS) checkStalled(now time.Time) {
+	var name string
+	var latency time.Duration
+	fs.mu.Lock()
+	for f := range fs.files {
+		start := atomic.LoadInt64(&f.opStart)
+		if start == 0 {
+			continue
+		}
+		if d := now.Sub(time.Unix(0, start)); d >= fs.threshold && d > latency {
+			name, latency = f.name, d
+		}
+	}
+	fs.mu.Unlock()
+	if latency > 0 {
+		fs.onSlow(name, latency)
+	}
+}
+
+// probe writes and syncs a file in the primary dir, returns the latency
+func (fs *walFailoverFS) probe() (time.Duration, error) {
+	name := fs.PathJoin(fs.primary, walProbeFile)
+	start := time.Now()
+	f, err := fs.FS.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Write(make([]byte, walProbeSize))
+	if err == nil {
+		err = f.Sync()
+	}
+	err = FirstError(err, f.Close())
+	err = FirstError(err, fs.FS.Remove(name))
+	return time.Since(start), err
+}
+
+// walFile times the writes and syncs of a primary WAL file, a write, sync or
+// preallocate stalled longer than threshold is abandoned, the file is moved to
+// the secondary dir and the op acked once synced there, so the commits don't
+// wait the stall.
+// notice: the move re-reads the completed writes from the primary file,
+// only the write in progress is kept in memory
+type walFile struct {
+	// unix nano start of the op in progress, 0 if none,
+	// first for the 64-bit atomic alignment
+	opStart int64
+	vfs.File
+	fs   *walFailoverFS
+	name string
+
+	mu sync.Mutex
+	// the primary ops run one at a time by the worker, so a stalled one can be abandoned
+	ops   chan func() error
+	done  chan error
+	timer *time.Timer
+	// the bytes of the completed primary writes
+	written int64
+	// the bytes of the write op, reused by the next write, nil once moved,
+	// as the abandoned op still owns it
+	buf []byte
+	// the secondary copy once moved, which takes the ops after
+	moved vfs.File
+}
+
+func newWALFile(fs *walFailoverFS, name string, f vfs.File) *walFile {
+	wf := &walFile{
+		File:  f,
+		fs:    fs,
+		name:  name,
+		ops:   make(chan func() error),
+		done:  make(chan error, 1),
+		timer: time.NewTimer(fs.threshold),
+	}
+	wf.stopTimer()
+	go wf.run()
+	return wf
+}
+
+// walFileMoved is the op result once moved to the secondary
+var walFileMoved = errors.New("wal file moved")
+
+// run runs the primary ops until closed, the abandoned primary file
+// is closed and removed once the stalled op returns.
+func (f *walFile) run() {
+	for op := range f.ops {
+		start := f.begin()
+		err := op()
+		f.end(start)
+		f.done <- err
+	}
+	if f.moved != nil {
+		f.untrack()
+		_ = f.File.Close()
+		_ = f.fs.FS.Remove(f.name)
+	}
+}
+
+func (f *walFile) begin() time.Time {
+	now := time.Now()
+	atomic.StoreInt64(&f.opStart, now.UnixNano())
+	return now
+}
+
+func (f *walFile) end(start time.Time) {
+	atomic.StoreInt64(&f.opStart, 0)
+	if d := time.Since(start); d >= f.fs.threshold {
+		f.fs.onSlow(f.name, d)
+	}
+}
+
+func (f *walFile) stopTimer() {
+	f.timer.Stop()
+	select {
+	case <-f.timer.C:
+	default:
+	}
+}
+
+// do runs the primary op up to threshold, then moves the file to the secondary,
+// returns walFileMoved if moved, or waits the op if the move failed,
+// pending is the bytes of a write op.
+// notice: the caller holds mu
+func (f *walFile) do(op func() error, pending []byte) error {
+	start := time.Now()
+	f.ops <- op
+	f.timer.Reset(f.fs.threshold)
+	select {
+	case err := <-f.done:
+		f.stopTimer()
+		return err
+	case <-f.timer.C:
+	}
+	f.fs.onSlow(f.name, time.Since(start))
+	if err := f.move(pending); err != nil {
+		return <-f.done
+	}
+	return walFileMoved
+}
+
+// move copies the completed writes of the primary file and the pending bytes
+// of the write in progress to the same file name in the secondary dir, and syncs it
+func (f *walFile) move(pending []byte) (err error) {
+	name := f.fs.PathJoin(f.fs.secondary, f.fs.PathBase(f.name))
+	sf, err := f.fs.FS.Create(name)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			err = FirstError(err, sf.Close())
+			err = FirstError(err, f.fs.FS.Remove(name))
+		}
+	}()
+	if err = f.copyWritten(sf); err != nil {
+		return
+	}
+	if _, err = sf.Write(pending); err != nil {
+		return
+	}
+	if err = sf.SyncData(); err != nil {
+		return
+	}
+	dir, err := f.fs.FS.OpenDir(f.fs.secondary)
+	if err != nil {
+		return
+	}
+	if err = FirstError(dir.Sync(), dir.Close()); err != nil {
+		return
+	}
+	f.moved, f.buf = sf, nil
+	return
+}
+
+// copyWritten copies the completed writes of the primary file to dst,
+// read with a new handle, as the WAL file may be opened write only
+func (f *walFile) copyWritten(dst vfs.File) error {
+	src, err := f.fs.FS.Open(f.name)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, io.NewSectionReader(src, 0, f.written))
+	if err == nil && n < f.written {
+		err = io.ErrUnexpectedEOF
+	}
+	return FirstError(err, src.Close())
+}
+
+func (f *walFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.moved != nil {
+		return f.moved.Write(p)
+	}
+	// the op owns a copy, which may be abandoned while the caller reuses p,
+	// and a write may modify the slice, the move writes p
+	f.buf = append(f.buf[:0], p...)
+	buf := f.buf
+	err := f.do(func() error {
+		n, err := f.File.Write(buf)
+		if err == nil && n < len(buf) {
+			err = io.ErrShortWrite
+		}
+		return err
+	}, p)
+	switch {
+	case err == walFileMoved:
+	case err != nil:
+		return 0, err
+	default:
+		f.written += int64(len(p))
+	}
+	return len(p), nil
+}
+
+// sync runs op on the primary file, or moved on the secondary copy once moved
+func (f *walFile) sync(op func() error, moved func(vfs.File) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.moved != nil {
+		return moved(f.moved)
+	}
+	if err := f.do(op, nil); err != walFileMoved {
+		return err
+	}
+	// synced by the move
+	return nil
+}
+
+func (f *walFile) Sync() error {
+	return f.sync(f.File.Sync, vfs.File.Sync)
+}
+
+func (f *walFile) SyncData() error {
+	return f.sync(f.File.SyncData, vfs.File.SyncData)
+}
+
+func (f *walFile) SyncTo(length int64) (fullSync bool, err error) {
+	f.mu.Lock()
+	moved := f.moved
+	f.mu.Unlock()
+	if moved != nil {
+		return moved.SyncTo(length)
+	}
+	// a full sync, as the partial one can't be moved
+	return true, f.SyncData()
+}
+
+// Preallocate is called by pebble before the writes, which may stall too
+func (f *walFile) Preallocate(offset, length int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.moved == nil {
+		err := f.do(func() error { return f.File.Preallocate(offset, length) }, nil)
+		if err != walFileMoved {
+			return err
+		}
+	}
+	return f.moved.Preallocate(offset, length)
+}
+
+// current returns the secondary copy once moved, or the primary file
+func (f *walFile) current() vfs.File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.moved != nil {
+		return f.moved
+	}
+	return f.File
+}
+
+func (f *walFile) Read(p []byte) (int, error) {
+	return f.current().Read(p)
+}
+
+func (f *walFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.current().ReadAt(p, off)
+}
+
+func (f *walFile) Prefetch(offset, length int64) error {
+	return f.current().Prefetch(offset, length)
+}
+
+func (f *walFile) Stat() (os.FileInfo, error) {
+	return f.current().Stat()
+}
+
+// Fd returns the fd of the secondary copy once moved
+func (f *walFile) Fd() uintptr {
+	return f.current().Fd()
+}
+
+// Close closes the file, the abandoned primary file is closed and removed
+// by the worker once the stalled op returns.
+func (f *walFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	close(f.ops)
+	if f.moved == nil {
+		f.untrack()
+		f.buf = nil
+		return f.File.Close()
+	}
+	return f.moved.Close()
+}
+
+func (f *walFile) untrack() {
+	f.fs.mu.Lock()
+	delete(f.fs.files, f)
+	f.fs.mu.Unlock()
+}
+
+// walDir syncs and closes the primary and secondary WAL dirs
+type walDir struct {
+	vfs.File
+	secondary vfs.File
+}
+
+func (d *walDir) Sync() error {
+	return FirstError(d.File.Sync(), d.secondary.Sync())
+}
+
+func (d *walDir) Close() error {
+	return FirstError(d.File.Close(), d.secondary.Close())
+}
+
+// WALOnSecondary returns true if the store writes the WAL in the secondary dir,
+// notice: false if not enabled with WithWALFailover
+func (s *PebbleKVStore) WALOnSecondary() bool {
+	return s.walFS != nil && s.walFS.onSecondary()
+}
+
+// onWALSlow fails over to the secondary dir, called by the pebble write goroutines
+// and the failover worker, so the switch is handled by the worker.
+func (l *eventListener) onWALSlow(path string, latency time.Duration) {
+	fs := l.kv.walFS
+	if !fs.switchTo(true) {
+		return
+	}
+	info := WALFailoverInfo{Secondary: true, Dir: fs.secondary, Path: path, Latency: latency}
+	select {
+	case l.walSwitched <- info:
+	default:
+	}
+}
+
+// onWALFailover logs the switch, calls the WithWALFailover listener,
+// and rotates the WAL, so the next writes go to the switched dir.
+func (l *eventListener) onWALFailover(info WALFailoverInfo) {
+	var secondary float32
+	if info.Secondary {
+		secondary = 1
+		metrics.IncrCounter([]string{"raft", "pebble", "wal", "failover"}, 1)
+		l.kv.logEvent(hclog.Warn, "WAL slow, fail over to the secondary dir",
+			"path", info.Path, "latency", info.Latency, "dir", info.Dir)
+	} else {
+		l.kv.logEvent(hclog.Info, "WAL primary healthy, fail back",
+			"probe", info.Latency, "dir", info.Dir)
+	}
+	metrics.SetGauge([]string{"raft", "pebble", "wal", "secondary"}, secondary)
+	if cb := l.kv.options.onWALFailover; cb != nil {
+		cb(info)
+	}
+
+	// a new memtable with a new WAL file, the stalled one is moved already
+	if l.kv.failure() != nil {
+		return
+	}
+	if _, err := l.kv.db.AsyncFlush(); err != nil {
+		l.kv.logEvent(hclog.Error, "rotate WAL failed", "error", err)
+	}
+}
+
+// runWALFailover checks the stalled primary WAL operations, handles the switches,
+// and probes the primary dir to fail back, until stop
+func (s *PebbleKVStore) runWALFailover() {
+	fs := s.walFS
+	interval := fs.threshold / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastProbe time.Time
+	healthy := 0
+	for {
+		select {
+		case info := <-s.event.walSwitched:
+			s.event.onWALFailover(info)
+			healthy = 0
+		case now := <-ticker.C:
+			fs.checkStalled(now)
+			if !fs.onSecondary() || now.Sub(lastProbe) < walProbeInterval {
+				continue
+			}
+			lastProbe = now
+			latency, err := fs.probe()
+			if err != nil || latency >= fs.threshold {
+				healthy = 0
+				continue
+			}
+			if healthy++; healthy < walFailbackProbes || !fs.switchTo(false) {
+				continue
+			}
+			healthy = 0
+			s.event.onWALFailover(WALFailoverInfo{Dir: fs.primary, Latency: latency})
+		case <-s.event.stopper.ShouldStop():
+			return
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package raftpebble
+
+import (
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/weedge/raft-pebble/errorfs"
+)
+
+// slowFS delays the writes and syncs of the files in dir
+type slowFS struct {
+	vfs.FS
+	dir   string
+	delay int64
+}
+
+func (fs *slowFS) setDelay(d time.Duration) {
+	atomic.StoreInt64(&fs.delay, int64(d))
+}
+
+func (fs *slowFS) Create(name string) (vfs.File, error) {
+	f, err := fs.FS.Create(name)
+	return fs.wrap(name, f), err
+}
+
+func (fs *slowFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	f, err := fs.FS.ReuseForWrite(oldname, newname)
+	return fs.wrap(newname, f), err
+}
+
+func (fs *slowFS) wrap(name string, f vfs.File) vfs.File {
+	if f == nil || fs.PathDir(name) != fs.dir {
+		return f
+	}
+	return &slowFile{File: f, fs: fs}
+}
+
+type slowFile struct {
+	vfs.File
+	fs *slowFS
+}
+
+func (f *slowFile) sleep() {
+	time.Sleep(time.Duration(atomic.LoadInt64(&f.fs.delay)))
+}
+
+func (f *slowFile) Write(p []byte) (int, error) {
+	f.sleep()
+	return f.File.Write(p)
+}
+
+func (f *slowFile) Sync() error {
+	f.sleep()
+	return f.File.Sync()
+}
+
+func walFiles(t *testing.T, fs vfs.FS, dir string) []string {
+	ls, err := fs.List(dir)
+	assert.NoError(t, err)
+	var wals []string
+	for _, name := range ls {
+		if strings.HasSuffix(name, walFileSuffix) {
+			wals = append(wals, name)
+		}
+	}
+	return wals
+}
+
+// walTestFS returns a strict mem fs with the synced dirs,
+// as pebble doesn't sync the parents of the db and WAL dirs
+func walTestFS(t *testing.T, dirs ...string) *vfs.MemFS {
+	fs := vfs.NewStrictMem()
+	for _, dir := range dirs {
+		assert.NoError(t, fs.MkdirAll(dir, 0755))
+	}
+	root, err := fs.OpenDir("")
+	assert.NoError(t, err)
+	assert.NoError(t, FirstError(root.Sync(), root.Close()))
+	return fs
+}
+
+// crashWAL closes the store dropping the unsynced writes, eg: the final flush,
+// so the reopen recovers the logs from the WAL files
+func crashWAL(t *testing.T, fs *vfs.MemFS, store *PebbleKVStore) {
+	fs.SetIgnoreSyncs(true)
+	assert.NoError(t, store.Close())
+	fs.ResetToSyncedState()
+	fs.SetIgnoreSyncs(false)
+}
+
+func waitWALSwitch(t *testing.T, events chan WALFailoverInfo, secondary bool) WALFailoverInfo {
+	select {
+	case info := <-events:
+		assert.Equal(t, secondary, info.Secondary)
+		return info
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no WAL switch to secondary %v", secondary)
+	}
+	return WALFailoverInfo{}
+}
+
+func TestPebbleKVStore_WALFailover(t *testing.T) {
+	dir, primary, secondary := "db", "wal", "wal2"
+	mem := walTestFS(t, dir, primary, secondary)
+	fs := &slowFS{FS: mem, dir: primary}
+	events := make(chan WALFailoverInfo, 4)
+	open := func() *PebbleKVStore {
+		store, err := New(
+			WithDbDirPath(dir),
+			WithWalDirPath(primary),
+			WithFS(fs),
+			WithSync(true),
+			WithWALFailover(secondary, 50*time.Millisecond, func(info WALFailoverInfo) {
+				events <- info
+			}),
+		)
+		if err != nil {
+			t.Fatalf("open err: %s", err)
+		}
+		return store
+	}
+
+	store := open()
+	index := uint64(0)
+	storeLogs := func(n int) {
+		for i := 0; i < n; i++ {
+			index++
+			assert.NoError(t, store.StoreLog(&raft.Log{Index: index, Term: 1, Data: []byte("data")}))
+		}
+	}
+	storeLogs(10)
+	assert.False(t, store.WALOnSecondary())
+	assert.Empty(t, walFiles(t, mem, secondary))
+
+	// a slow primary write fails over, the WAL is rotated to the secondary
+	fs.setDelay(200 * time.Millisecond)
+	storeLogs(1)
+	info := waitWALSwitch(t, events, true)
+	assert.Equal(t, filepath.Clean(secondary), info.Dir)
+	assert.True(t, info.Latency >= 50*time.Millisecond)
+	assert.True(t, store.WALOnSecondary())
+	deadline := time.Now().Add(5 * time.Second)
+	for len(walFiles(t, mem, secondary)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no WAL file in the secondary dir")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	start := time.Now()
+	storeLogs(10)
+	assert.True(t, time.Since(start) < 200*time.Millisecond, "writes not on the secondary")
+
+	// the logs only in the secondary WAL are recovered
+	checkLogs := func() {
+		last, err := store.LastIndex()
+		assert.NoError(t, err)
+		assert.Equal(t, index, last)
+		for i := uint64(1); i <= index; i++ {
+			assert.NoError(t, store.GetLog(i, new(raft.Log)))
+		}
+	}
+	fs.setDelay(0)
+	crashWAL(t, mem, store)
+	store = open()
+	checkLogs()
+	assert.False(t, store.WALOnSecondary())
+
+	// the primary probes healthy, fails back
+	fs.setDelay(200 * time.Millisecond)
+	storeLogs(1)
+	waitWALSwitch(t, events, true)
+	fs.setDelay(0)
+	info = waitWALSwitch(t, events, false)
+	assert.Equal(t, filepath.Clean(primary), info.Dir)
+	assert.False(t, store.WALOnSecondary())
+	storeLogs(10)
+	crashWAL(t, mem, store)
+
+	// the logs in the WAL files of both dirs are recovered
+	store = open()
+	defer store.Close()
+	checkLogs()
+}
+
+// stallInjector blocks the ops of the WAL files in dir until released,
+// the writes and syncs if ops is empty
+type stallInjector struct {
+	dir     string
+	ops     []errorfs.Op
+	enabled int32
+	release chan struct{}
+}
+
+func (i *stallInjector) stalls(op errorfs.Op) bool {
+	if len(i.ops) == 0 {
+		return op == errorfs.OpFileWrite || op == errorfs.OpFileSync
+	}
+	for _, o := range i.ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *stallInjector) MaybeError(op errorfs.Op, path string) error {
+	if atomic.LoadInt32(&i.enabled) == 1 && i.stalls(op) &&
+		filepath.Dir(path) == i.dir && strings.HasSuffix(path, walFileSuffix) {
+		<-i.release
+	}
+	return nil
+}
+
+func TestPebbleKVStore_WALFailover_Stall(t *testing.T) {
+	dir, primary, secondary := "db", "wal", "wal2"
+	mem := walTestFS(t, dir, primary, secondary)
+	inj := &stallInjector{dir: primary, release: make(chan struct{})}
+	events := make(chan WALFailoverInfo, 4)
+	opts := []Option{
+		WithDbDirPath(dir),
+		WithWalDirPath(primary),
+		WithSync(true),
+	}
+	store, err := New(append(opts,
+		WithFS(errorfs.Wrap(mem, inj)),
+		WithWALFailover(secondary, 50*time.Millisecond, func(info WALFailoverInfo) {
+			events <- info
+		}))...)
+	assert.NoError(t, err)
+
+	var index uint64
+	storeLogs := func(n int) {
+		for i := 0; i < n; i++ {
+			index++
+			assert.NoError(t, store.StoreLog(&raft.Log{Index: index, Term: 1, Data: []byte("data")}))
+		}
+	}
+	storeLogs(10)
+
+	// the stalled primary write is moved to the secondary, the writes go on
+	atomic.StoreInt32(&inj.enabled, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		storeLogs(20)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked by the stalled primary WAL")
+	}
+	waitWALSwitch(t, events, true)
+	assert.True(t, store.WALOnSecondary())
+	assert.NotEmpty(t, walFiles(t, mem, secondary))
+
+	// the primary copy of the moved file is left with the synced bytes
+	close(inj.release)
+	crashWAL(t, mem, store)
+
+	// the moved WAL files are recovered
+	store, err = New(append(opts, WithFS(mem), WithWALFailover(secondary, 50*time.Millisecond, nil))...)
+	assert.NoError(t, err)
+	defer store.Close()
+	last, err := store.LastIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, index, last)
+	for i := uint64(1); i <= index; i++ {
+		assert.NoError(t, store.GetLog(i, new(raft.Log)))
+	}
+}
+
+// fdFS gives the files a fake fd, so pebble preallocates the WAL files
+type fdFS struct {
+	vfs.FS
+}
+
+func (fs fdFS) Create(name string) (vfs.File, error) {
+	f, err := fs.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return fdFile{f}, nil
+}
+
+func (fs fdFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	f, err := fs.FS.ReuseForWrite(oldname, newname)
+	if err != nil {
+		return nil, err
+	}
+	return fdFile{f}, nil
+}
+
+type fdFile struct {
+	vfs.File
+}
+
+func (f fdFile) Fd() uintptr {
+	return 1
+}
+
+func TestPebbleKVStore_WALFailover_PreallocateStall(t *testing.T) {
+	dir, primary, secondary := "db", "wal", "wal2"
+	mem := walTestFS(t, dir, primary, secondary)
+	inj := &stallInjector{dir: primary, ops: []errorfs.Op{errorfs.OpFilePreallocate}, release: make(chan struct{})}
+	events := make(chan WALFailoverInfo, 4)
+	opts := []Option{
+		WithDbDirPath(dir),
+		WithWalDirPath(primary),
+		WithSync(true),
+	}
+	store, err := New(append(opts,
+		WithFS(fdFS{errorfs.Wrap(mem, inj)}),
+		WithWALFailover(secondary, 50*time.Millisecond, func(info WALFailoverInfo) {
+			events <- info
+		}))...)
+	assert.NoError(t, err)
+
+	var index uint64
+	storeLogs := func(n int) {
+		for i := 0; i < n; i++ {
+			index++
+			assert.NoError(t, store.StoreLog(&raft.Log{Index: index, Term: 1, Data: []byte("data")}))
+		}
+	}
+	storeLogs(10)
+
+	// the first write of a new primary WAL file preallocates it, which stalls,
+	// the file is moved to the secondary, the writes go on
+	atomic.StoreInt32(&inj.enabled, 1)
+	_, err = store.db.AsyncFlush()
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		storeLogs(20)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked by the stalled primary WAL preallocate")
+	}
+	info := waitWALSwitch(t, events, true)
+	assert.Contains(t, walFiles(t, mem, secondary), filepath.Base(info.Path))
+
+	close(inj.release)
+	crashWAL(t, mem, store)
+
+	// the moved WAL file is recovered
+	store, err = New(append(opts, WithFS(mem), WithWALFailover(secondary, 50*time.Millisecond, nil))...)
+	assert.NoError(t, err)
+	defer store.Close()
+	last, err := store.LastIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, index, last)
+	for i := uint64(1); i <= index; i++ {
+		assert.NoError(t, store.GetLog(i, new(raft.Log)))
+	}
+}